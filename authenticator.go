@@ -1,8 +1,8 @@
 package service
 
 import (
+	"cmp"
 	"context"
-	"crypto/rsa"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -10,7 +10,6 @@ import (
 	"log"
 	"net/http"
 	"net/url"
-	"os"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -24,22 +23,135 @@ type Authenticator struct {
 	ClientID     string
 	ClientSecret string
 
-	tk        atomic.Pointer[jwtToken]
-	publicKey *rsa.PublicKey
-	client    *http.Client
-
-	refreshMu sync.Mutex
+	// TokenEndpoint and JWKSURI are discovered from Host's
+	// /.well-known/openid-configuration unless configured explicitly, falling back
+	// to Host/token and Host/.well-known/jwks.json for servers without discovery.
+	TokenEndpoint string
+	JWKSURI       string
+
+	// Issuers and Audiences, when not empty, list the accepted iss and aud values
+	// for VerifyClaims; Issuers defaults to the discovered issuer. Leeway is the
+	// tolerated clock skew, DefaultLeeway unless changed. Set them right after
+	// construction, before verifying tokens.
+	Issuers   []string
+	Audiences []string
+	Leeway    time.Duration
+
+	// Algorithms lists the accepted JWS signature algorithms, RS256 unless changed.
+	Algorithms []jose.SignatureAlgorithm
+
+	// VerifyMode selects how VerifyClaims checks tokens; VerifyJWT by default.
+	// IntrospectionEndpoint is discovered like TokenEndpoint, falling back to
+	// Host/introspect.
+	VerifyMode            VerifyMode
+	IntrospectionEndpoint string
+
+	// RevocationEndpoint is discovered like TokenEndpoint, falling back to
+	// Host/revoke. It is used by Close when RevokeOnClose is configured.
+	RevocationEndpoint string
+
+	// DeviceAuthorizationEndpoint is discovered like TokenEndpoint, falling back
+	// to Host/device. It is only used with DeviceAuthorization configured.
+	DeviceAuthorizationEndpoint string
+
+	tk     atomic.Pointer[jwtToken]
+	jwks   *keySet
+	client *http.Client
+
+	grantParams  url.Values
+	refreshRatio float64
+	idleTimeout  time.Duration
+
+	authMethod      ClientAuthMethod
+	assertionSigner jose.Signer
+
+	store    TokenStore
+	storeKey string
+
+	deviceAuth func(ctx context.Context, code DeviceCode) error
+
+	dpop        *dpopKey
+	insecureRPC bool
+
+	// ctx bounds the background refreshers, which Close cancels and waits for
+	// through wg. closed, guarded by scopedMu, stops new scoped refreshers from
+	// starting once Close has begun. closeDone, guarded by closeMu, is set once
+	// Close has waited for them and revoked the tokens.
+	ctx       context.Context
+	cancel    context.CancelFunc
+	wg        sync.WaitGroup
+	closeOnce sync.Once
+	closed    bool
+	closeMu   sync.Mutex
+	closeDone bool
+	revoke    bool
+
+	scopedMu sync.Mutex
+	scoped   map[string]*scopedToken
+
+	exchanged     *ttlCache[string]
+	introspected  *ttlCache[*introspection]
+	introspectTTL time.Duration
+
+	verified     *ttlCache[*verifiedToken]
+	verifyHits   atomic.Uint64
+	verifyMisses atomic.Uint64
+
+	refreshMu    ctxMutex
+	maxStaleness time.Duration
+
+	observer Observer
+
+	status   refreshStatus
+	retryMin time.Duration
+	retryMax time.Duration
 }
+
 type jwtToken struct {
 	AccessToken  string `json:"access_token"`
 	RefreshToken string `json:"refresh_token"`
 	ExpireIn     int    `json:"expires_in"`
+	// TokenType is DPoP for tokens bound to the DPoP key, Bearer otherwise.
+	TokenType string `json:"token_type"`
+	// RefreshExpireIn is the refresh token's lifetime, sent by some servers such
+	// as Keycloak.
+	RefreshExpireIn int `json:"refresh_expires_in"`
 
 	expiresAt time.Time
 }
 
 const tokenExpiryLeeway = 10 * time.Second
 
+// ctxMutex serializes token refreshes like a sync.Mutex, but lets a waiter give
+// up when its context is done. The zero value is unlocked.
+type ctxMutex struct {
+	once sync.Once
+	ch   chan struct{}
+}
+
+func (m *ctxMutex) lock(ctx context.Context) error {
+	m.once.Do(func() {
+		m.ch = make(chan struct{}, 1)
+	})
+
+	select {
+	case m.ch <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (m *ctxMutex) unlock() {
+	<-m.ch
+}
+
+// refreshAt returns when tk reaches ratio of its lifetime.
+func (tk *jwtToken) refreshAt(ratio float64) time.Time {
+	d := time.Duration(tk.ExpireIn) * time.Second
+	return tk.expiresAt.Add(-time.Duration(float64(d) * (1 - ratio)))
+}
+
 func (tk *jwtToken) expired() bool {
 	if tk.expiresAt.IsZero() {
 		return false
@@ -51,57 +163,200 @@ var (
 	ErrAuthHostNotFound         = errors.New("AUTH_HOST not found")
 	ErrAuthClientIDNotFound     = errors.New("AUTH_CLIENT_ID not found")
 	ErrAuthClientSecretNotFound = errors.New("AUTH_CLIENT_SECRET not found")
+
+	ErrTokenUnavailable = errors.New("no valid token available")
+
+	ErrUnknownKeyID         = errors.New("no JWK matches token kid")
+	ErrKeyAlgorithmMismatch = errors.New("JWK does not match token algorithm")
 )
 
+// NewAuthenticator creates an Authenticator configured from the AUTH_HOST,
+// AUTH_CLIENT_ID, AUTH_CLIENT_SECRET, AUTH_TOKEN_ENDPOINT, AUTH_JWKS_URI,
+// JWKS_KEY_ID, AUTH_METHOD, AUTH_PRIVATE_KEY and AUTH_PRIVATE_KEY_ID environment
+// variables. See NewAuthenticatorWithConfig.
 func NewAuthenticator(ctx context.Context) (*Authenticator, error) {
-	t := &Authenticator{
-		Host:         os.Getenv("AUTH_HOST"),
-		ClientID:     os.Getenv("AUTH_CLIENT_ID"),
-		ClientSecret: os.Getenv("AUTH_CLIENT_SECRET"),
-		client:       &http.Client{Timeout: time.Minute},
-	}
+	return NewAuthenticatorWithConfig(ctx, authConfigFromEnv())
+}
 
-	if t.Host == "" {
+// NewAuthenticatorWithConfig resolves the auth service's endpoints, loads its JWKS
+// and obtains the first token. The token and the JWKS are then kept fresh in the
+// background until ctx is cancelled or Close is called.
+func NewAuthenticatorWithConfig(ctx context.Context, cfg AuthConfig) (*Authenticator, error) {
+	if cfg.Host == "" && (cfg.TokenEndpoint == "" || cfg.JWKSURI == "") {
 		return nil, ErrAuthHostNotFound
 	}
-	if t.ClientID == "" {
+	if cfg.ClientID == "" {
 		return nil, ErrAuthClientIDNotFound
 	}
-	if t.ClientSecret == "" {
-		return nil, ErrAuthClientSecretNotFound
+
+	authMethod := cmp.Or(cfg.AuthMethod, ClientSecretPost)
+	if cfg.AuthMethod == "" && cfg.DeviceAuthorization != nil && cfg.ClientSecret == "" {
+		authMethod = ClientNone
+	}
+	switch authMethod {
+	case ClientNone:
+	case ClientSecretPost, ClientSecretBasic:
+		if cfg.ClientSecret == "" {
+			return nil, ErrAuthClientSecretNotFound
+		}
+	case PrivateKeyJWT:
+		if cfg.PrivateKey == nil && cfg.PrivateKeyFile == "" {
+			return nil, ErrAuthPrivateKeyNotFound
+		}
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrUnsupportedAuthMethod, authMethod)
 	}
 
-	publicKey, err := getPublicKey(ctx, t.Host)
-	if err != nil {
+	client, metaClient := cfg.httpClients()
+
+	t := &Authenticator{
+		Host:          cfg.Host,
+		ClientID:      cfg.ClientID,
+		ClientSecret:  cfg.ClientSecret,
+		TokenEndpoint: cfg.TokenEndpoint,
+		JWKSURI:       cfg.JWKSURI,
+		Issuers:       cfg.Issuers,
+		Audiences:     cfg.Audiences,
+		Leeway:        cmp.Or(cfg.Leeway, DefaultLeeway),
+		Algorithms:    cfg.Algorithms,
+		VerifyMode:    cfg.VerifyMode,
+
+		IntrospectionEndpoint:       cfg.IntrospectionEndpoint,
+		RevocationEndpoint:          cfg.RevocationEndpoint,
+		DeviceAuthorizationEndpoint: cfg.DeviceAuthorizationEndpoint,
+
+		client:        client,
+		grantParams:   scopeParams("", cfg.Scopes),
+		idleTimeout:   cmp.Or(cfg.TokenIdleTimeout, defaultTokenIdleTimeout),
+		refreshRatio:  cfg.RefreshRatio,
+		authMethod:    authMethod,
+		revoke:        cfg.RevokeOnClose,
+		store:         cfg.TokenStore,
+		deviceAuth:    cfg.DeviceAuthorization,
+		insecureRPC:   cfg.InsecureRPC,
+		scoped:        map[string]*scopedToken{},
+		exchanged:     newTTLCache[string](cmp.Or(max(cfg.ExchangeCacheSize, 0), defaultExchangeCacheSize)),
+		introspected:  newTTLCache[*introspection](cmp.Or(max(cfg.IntrospectionCacheSize, 0), defaultIntrospectionCacheSize)),
+		introspectTTL: cmp.Or(cfg.IntrospectionCacheTTL, defaultIntrospectionCacheTTL),
+		observer:      cfg.Observer,
+		maxStaleness:  cfg.MaxStaleness,
+		retryMin:      cmp.Or(cfg.RetryMin, defaultRetryMin),
+		retryMax:      cmp.Or(cfg.RetryMax, defaultRetryMax),
+	}
+	if len(t.Algorithms) == 0 {
+		t.Algorithms = []jose.SignatureAlgorithm{jose.RS256}
+	}
+	if t.refreshRatio <= 0 || t.refreshRatio >= 1 {
+		t.refreshRatio = defaultRefreshRatio
+	}
+	t.retryMax = max(t.retryMax, t.retryMin)
+	if t.observer == nil {
+		t.observer = NopObserver{}
+	}
+	if cfg.VerifyCacheSize > 0 {
+		t.verified = newTTLCache[*verifiedToken](cfg.VerifyCacheSize)
+	}
+
+	if cfg.DPoP {
+		if cfg.TokenStore != nil {
+			return nil, errors.New("DPoP cannot be used with a TokenStore: tokens are bound to a key of this process")
+		}
+
+		key, err := newDPoPKey()
+		if err != nil {
+			return nil, err
+		}
+		t.dpop = key
+	}
+
+	if authMethod == PrivateKeyJWT {
+		key := cfg.PrivateKey
+		if key == nil {
+			var err error
+			if key, err = LoadPrivateKey(cfg.PrivateKeyFile); err != nil {
+				return nil, fmt.Errorf("failed to load private key: %w", err)
+			}
+		}
+
+		signer, err := newAssertionSigner(key, cfg.PrivateKeyID, cfg.PrivateKeyAlgorithm)
+		if err != nil {
+			return nil, err
+		}
+		t.assertionSigner = signer
+	}
+
+	if err := t.resolveEndpoints(ctx, metaClient); err != nil {
 		return nil, err
 	}
-	t.publicKey = publicKey
 
-	tk, err := t.token(ctx, nil)
+	if t.store != nil {
+		prefix := "token:"
+		if t.deviceAuth != nil {
+			prefix = "device:"
+		}
+		t.storeKey = prefix + tokenHash(t.TokenEndpoint+"\x00"+t.ClientID+"\x00"+t.grantParams.Encode())
+	}
+
+	t.jwks = &keySet{
+		uri:      t.JWKSURI,
+		keyID:    cfg.KeyID,
+		client:   metaClient,
+		observer: t.observer,
+	}
+	if t.verified != nil {
+		t.jwks.onChange = t.verified.clear
+	}
+	jwksInterval, err := t.jwks.load(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get token: %w", err)
+		return nil, err
+	}
+
+	switch {
+	case t.deviceAuth != nil:
+		// A previous run may have left a token in the store.
+		if err := t.login(ctx, true); err != nil {
+			return nil, fmt.Errorf("failed to log in: %w", err)
+		}
+	case t.store != nil:
+		// Another replica may already hold a valid token.
+		if err := t.refreshShared(ctx, nil); err != nil {
+			return nil, fmt.Errorf("failed to get token: %w", err)
+		}
+	default:
+		tk, err := t.token(ctx, nil, t.grantParams)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get token: %w", err)
+		}
+		t.tk.Store(tk)
 	}
-	t.tk.Store(tk)
+	t.recordRefresh(nil)
+
+	t.ctx, t.cancel = context.WithCancel(ctx)
 
 	ticker := time.NewTicker(t.refreshInterval())
 
-	go func() {
+	t.wg.Go(func() {
 		defer ticker.Stop()
 	loop:
 		for {
 			select {
 			case <-ticker.C:
-				if err := t.refresh(ctx, t.tk.Load()); err != nil {
-					log.Printf("[ERROR] failed to refresh token: %v", err)
-					ticker.Reset(time.Minute)
+				if err := t.refresh(t.ctx, t.tk.Load()); err != nil {
+					delay := t.retryAfter(t.Status().Failures)
+					log.Printf("[ERROR] failed to refresh token, retrying in %s: %v", delay.Round(time.Millisecond), err)
+					ticker.Reset(delay)
 					continue
 				}
 				ticker.Reset(t.refreshInterval())
-			case <-ctx.Done():
+			case <-t.ctx.Done():
 				break loop
 			}
 		}
-	}()
+	})
+
+	t.wg.Go(func() {
+		t.jwks.run(t.ctx, jwksInterval)
+	})
 
 	return t, nil
 }
@@ -110,27 +365,60 @@ func NewAuthenticator(ctx context.Context) (*Authenticator, error) {
 // has expired (e.g. the background refresher stalled or its context was
 // canceled), it refreshes on demand before returning, so freshness does not
 // depend on the background goroutine being alive. If that refresh fails it falls
-// back to the existing token rather than an empty string.
+// back to the existing token rather than an empty string; use TokenContext to
+// bound the refresh and learn about its failure.
 func (t *Authenticator) Token() string {
+	tk := t.current(context.Background())
+	if tk == nil {
+		return ""
+	}
+
+	return tk.AccessToken
+}
+
+// TokenContext returns the current access token like Token, but the on-demand
+// refresh of a missing or expired token is bounded by ctx, and its failure is
+// reported as an error wrapping ErrTokenUnavailable instead of returning the
+// expired token. With MaxStaleness configured, a token that expired less than
+// MaxStaleness ago is still returned when the refresh fails, so a short auth
+// service outage does not fail every request right away.
+func (t *Authenticator) TokenContext(ctx context.Context) (string, error) {
+	tk := t.tk.Load()
+	if tk != nil && !tk.expired() {
+		return tk.AccessToken, nil
+	}
+
+	err := t.refresh(ctx, tk)
+	if err == nil {
+		return t.tk.Load().AccessToken, nil
+	}
+
+	if tk = t.tk.Load(); tk != nil && t.maxStaleness > 0 && time.Since(tk.expiresAt) < t.maxStaleness {
+		log.Printf("[WARN] failed to refresh token, using stale token: %v", err)
+		return tk.AccessToken, nil
+	}
+
+	return "", fmt.Errorf("%w: %w", ErrTokenUnavailable, err)
+}
+
+// current returns the held token, refreshing it first when it is missing or expired.
+func (t *Authenticator) current(ctx context.Context) *jwtToken {
 	tk := t.tk.Load()
 
 	if tk == nil || tk.expired() {
-		if err := t.refresh(context.Background(), tk); err != nil {
+		if err := t.refresh(ctx, tk); err != nil {
 			log.Printf("[ERROR] failed to refresh token: %v", err)
 		}
 		tk = t.tk.Load()
 	}
 
-	if tk == nil {
-		return ""
-	}
-
-	return tk.AccessToken
+	return tk
 }
 
 // Refresh forces a token refresh and reports whether a new token was obtained.
 // Call it when a downstream request made with Token() comes back 401
-// (Unauthorized), then retry the request with the refreshed Token().
+// (Unauthorized), then retry the request with the refreshed Token(). Client and
+// Transport do this automatically.
 func (t *Authenticator) Refresh(ctx context.Context) bool {
 	if err := t.refresh(ctx, t.tk.Load()); err != nil {
 		log.Printf("[ERROR] failed to refresh token: %v", err)
@@ -139,60 +427,114 @@ func (t *Authenticator) Refresh(ctx context.Context) bool {
 	return true
 }
 
-// Verify validates the signature of the given JWT against the auth service's public key
-// and returns the decoded payload.
+// Verify validates the signature of the given JWT against the auth service's JWKS
+// and returns the decoded payload. The key is selected by the token's kid header;
+// tokens without a kid are checked against every published key. An unknown kid
+// triggers a rate-limited JWKS refetch, so keys added by a rotation are picked up
+// before the next scheduled reload.
+//
+// Verify does not look at the claims; use VerifyClaims to also enforce expiry,
+// issuer and audience.
 func (t *Authenticator) Verify(token string) ([]byte, error) {
-	jws, err := jose.ParseSigned(token, []jose.SignatureAlgorithm{jose.RS256})
+	payload, err := t.verify(context.Background(), token)
+	return payload, t.observeVerify(err)
+}
+
+// VerifyClaims verifies the token like Verify and validates its registered claims:
+// exp, nbf and iat with the configured Leeway, iss against Issuers and aud against
+// Audiences. Validation failures wrap ErrTokenExpired, ErrTokenNotYetValid,
+// ErrTokenWrongIssuer or ErrTokenWrongAudience. When custom is not nil the payload
+// is also decoded into it, so callers can read their own claims.
+//
+// Depending on VerifyMode the token is instead, or for opaque tokens, checked
+// with Introspect; the returned claims have the same shape either way.
+func (t *Authenticator) VerifyClaims(ctx context.Context, token string, custom any) (*Claims, error) {
+	claims, err := t.verifyClaims(ctx, token, custom)
+	return claims, t.observeVerify(err)
+}
+
+func (t *Authenticator) verifyClaims(ctx context.Context, token string, custom any) (*Claims, error) {
+	switch t.VerifyMode {
+	case VerifyIntrospect:
+		return t.introspect(ctx, token, custom)
+	case VerifyAuto:
+		if !looksLikeJWT(token) {
+			return t.introspect(ctx, token, custom)
+		}
+	}
+
+	payload, err := t.verify(ctx, token)
 	if err != nil {
-		return nil, fmt.Errorf("parse token: %w", err)
+		return nil, err
 	}
 
-	// publicKey is immutable after construction, so no synchronisation is needed.
-	payload, err := jws.Verify(t.publicKey)
+	return decodeClaims(payload, custom, t.Leeway, t.Issuers, t.Audiences)
+}
+
+// verifySignature checks token's signature against the JWKS and returns its payload.
+func (t *Authenticator) verifySignature(ctx context.Context, token string) ([]byte, error) {
+	jws, err := jose.ParseSigned(token, t.Algorithms)
 	if err != nil {
-		return nil, fmt.Errorf("verify token: %w", err)
+		return nil, fmt.Errorf("%w: %w", ErrTokenMalformed, err)
 	}
-	return payload, nil
+
+	return t.jwks.verify(ctx, jws)
 }
 
 // token requests a token from the auth service. When cur carries a refresh token
-// the refresh_token grant is used; otherwise it performs a client_credentials grant.
-func (t *Authenticator) token(ctx context.Context, cur *jwtToken) (*jwtToken, error) {
+// the refresh_token grant is used; otherwise it performs a client_credentials grant
+// with params, such as scope and audience, added to the form.
+func (t *Authenticator) token(ctx context.Context, cur *jwtToken, params url.Values) (*jwtToken, error) {
 	data := url.Values{}
 
 	if cur == nil || cur.RefreshToken == "" {
 		data.Set("grant_type", "client_credentials")
-		data.Set("client_id", t.ClientID)
-		data.Set("client_secret", t.ClientSecret)
+		for k, v := range params {
+			data[k] = v
+		}
 	} else {
 		data.Set("grant_type", "refresh_token")
 		data.Set("refresh_token", cur.RefreshToken)
 	}
 
-	uri := fmt.Sprintf("%s/token", t.Host)
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, uri, strings.NewReader(data.Encode()))
+	tk, err := t.tokenRequest(ctx, data)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create request to %s: %w", uri, err)
+		return nil, err
 	}
 
-	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-	req.Header.Set("Accept", "application/json")
+	// Servers that do not rotate refresh tokens leave them out of the response
+	// (RFC 6749, section 6); the current one stays valid.
+	if data.Get("grant_type") == "refresh_token" && tk.RefreshToken == "" {
+		tk.RefreshToken = cur.RefreshToken
+		tk.RefreshExpireIn = cur.RefreshExpireIn
+	}
 
-	resp, err := t.client.Do(req)
+	return tk, nil
+}
+
+// tokenRequest posts a grant to the token endpoint, authenticating the client
+// with the configured method, and decodes the issued token.
+func (t *Authenticator) tokenRequest(ctx context.Context, data url.Values) (tk *jwtToken, err error) {
+	start := time.Now()
+	defer func() {
+		t.observer.OnGrant(GrantEvent{GrantType: data.Get("grant_type"), Duration: time.Since(start), Err: err})
+	}()
+
+	resp, err := t.postForm(ctx, t.TokenEndpoint, data)
 	if err != nil {
-		return nil, fmt.Errorf("failed to make request: %w", err)
+		return nil, err
 	}
 	defer func() {
 		_ = resp.Body.Close()
 	}()
 
-	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("%d: %s", resp.StatusCode, string(body))
-	}
+	return decodeToken(resp.Body)
+}
 
+// decodeToken decodes a successful token response.
+func decodeToken(body io.Reader) (*jwtToken, error) {
 	token := &jwtToken{}
-	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+	if err := json.NewDecoder(body).Decode(&token); err != nil {
 		return nil, fmt.Errorf("failed to decode response from auth service: %w", err)
 	}
 
@@ -203,115 +545,169 @@ func (t *Authenticator) token(ctx context.Context, cur *jwtToken) (*jwtToken, er
 	return token, nil
 }
 
-// refresh obtains a new token and atomically swaps it in. It first tries the
-// refresh_token grant and, on failure, falls back to a fresh client_credentials
-// grant. The currently stored token is left untouched until a new one is
-// successfully fetched, so Token() never observes an empty value.
-//
-// old is the token the caller observed before deciding to refresh. If another
-// goroutine already replaced it while this one waited for refreshMu, the refresh
-// is skipped — collapsing a burst of concurrent 401s into a single network call.
-func (t *Authenticator) refresh(ctx context.Context, old *jwtToken) error {
-	t.refreshMu.Lock()
-	defer t.refreshMu.Unlock()
+// postForm posts data to one of the auth service's endpoints with the client's
+// credentials. Any status other than 200 is returned as an error; otherwise the
+// caller must close the response body. With DPoP, requests to the token endpoint
+// carry a proof, and are sent again when the server asks for a nonce.
+func (t *Authenticator) postForm(ctx context.Context, uri string, data url.Values) (*http.Response, error) {
+	resp, err := t.post(ctx, uri, data)
 
-	cur := t.tk.Load()
-	if old != nil && cur != old {
-		return nil
+	var oerr *oauthError
+	if t.dpop != nil && uri == t.TokenEndpoint && errors.As(err, &oerr) && oerr.Code == "use_dpop_nonce" {
+		return t.post(ctx, uri, data)
 	}
 
-	tk, err := t.token(ctx, cur)
+	return resp, err
+}
+
+// post makes one postForm attempt.
+func (t *Authenticator) post(ctx context.Context, uri string, data url.Values) (*http.Response, error) {
+	header := http.Header{}
+	if err := t.clientAuth(uri, data, header); err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, uri, strings.NewReader(data.Encode()))
 	if err != nil {
-		// The refresh token may be expired/revoked; re-authenticate from scratch.
-		tk, err = t.token(ctx, nil)
+		return nil, fmt.Errorf("failed to create request to %s: %w", uri, err)
+	}
+
+	req.Header = header
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	if t.dpop != nil && uri == t.TokenEndpoint {
+		proof, err := t.dpop.proof(http.MethodPost, uri, "")
 		if err != nil {
-			return err
+			return nil, fmt.Errorf("failed to create DPoP proof: %w", err)
 		}
+		req.Header.Set("DPoP", proof)
 	}
 
-	t.tk.Store(tk)
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to make request: %w", err)
+	}
 
-	return nil
-}
+	if t.dpop != nil {
+		t.dpop.track(uri, resp)
+	}
 
-// refreshInterval returns how long to wait before refreshing the current token,
-// scheduling the refresh at ~80% of the token's lifetime so the margin scales
-// with short-lived tokens instead of a fixed offset that could exceed the TTL.
-func (t *Authenticator) refreshInterval() time.Duration {
-	tk := t.tk.Load()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
 
-	if tk == nil || tk.ExpireIn <= 0 {
-		return time.Minute
+		oerr := &oauthError{status: resp.StatusCode, body: string(body)}
+		_ = json.Unmarshal(body, oerr)
+		return nil, oerr
 	}
 
-	d := time.Duration(tk.ExpireIn) * time.Second
+	return resp, nil
+}
 
-	return d - d/5
+// oauthError is an error response from the auth service. Code and Description are
+// set when the body is an OAuth error (RFC 6749, section 5.2).
+type oauthError struct {
+	status      int
+	body        string
+	Code        string `json:"error"`
+	Description string `json:"error_description"`
 }
 
-func getPublicKey(ctx context.Context, host string) (*rsa.PublicKey, error) {
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s/.well-known/jwks.json", host), nil)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create request: %w", err)
-	}
+func (e *oauthError) Error() string {
+	return fmt.Sprintf("%d: %s", e.status, e.body)
+}
 
-	client := http.Client{
-		Timeout: time.Second * 3,
+// refresh obtains a new token and atomically swaps it in. It first tries the
+// refresh_token grant and, on failure, falls back to a fresh client_credentials
+// grant. The currently stored token is left untouched until a new one is
+// successfully fetched, so Token() never observes an empty value.
+//
+// old is the token the caller observed before deciding to refresh. If another
+// goroutine already replaced it while this one waited for refreshMu, the refresh
+// is skipped — collapsing a burst of concurrent 401s into a single network call.
+func (t *Authenticator) refresh(ctx context.Context, old *jwtToken) error {
+	var err error
+	if t.store != nil {
+		err = t.refreshShared(ctx, old)
+	} else {
+		err = t.refreshToken(ctx, &t.refreshMu, &t.tk, old, t.grantParams)
 	}
-
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, err
-	}
-	defer func() {
-		_ = resp.Body.Close()
-	}()
-
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("wrong status code: %d (%s)", resp.StatusCode, http.StatusText(resp.StatusCode))
+	// A caller that gave up says nothing about the auth service.
+	if err == nil || ctx.Err() == nil {
+		t.recordRefresh(err)
 	}
+	return err
+}
 
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, err
+// refreshToken implements refresh for any token slot guarded by mu, so scoped
+// tokens share the same collapsing and fallback behaviour as the main token.
+// params are sent with the client_credentials grant.
+func (t *Authenticator) refreshToken(ctx context.Context, mu *ctxMutex, slot *atomic.Pointer[jwtToken], old *jwtToken, params url.Values) error {
+	if err := mu.lock(ctx); err != nil {
+		return err
 	}
+	defer mu.unlock()
 
-	var jwks = jose.JSONWebKeySet{}
-	if err := json.Unmarshal(body, &jwks); err != nil {
-		return nil, err
+	cur := slot.Load()
+	if old != nil && cur != old {
+		return nil
 	}
 
-	publicJWKS := jwks.Keys
-	if len(publicJWKS) == 0 {
-		return nil, errors.New("public JWKS not found")
+	tk, err := t.grant(ctx, cur, params)
+	if err != nil {
+		return err
 	}
 
-	publicJWK := publicJWKS[0]
+	slot.Store(tk)
 
-	if keyID := os.Getenv("JWKS_KEY_ID"); keyID != "" {
-		found := false
+	return nil
+}
 
-		for _, key := range publicJWKS {
-			if key.KeyID == keyID {
-				publicJWK = key
-				found = true
-				break
-			}
+// grant renews cur with the refresh_token grant, falling back to a fresh
+// client_credentials grant with params. A user's tokens obtained with
+// DeviceAuthorization have no such fallback; once the refresh token stops
+// working the user must log in again.
+func (t *Authenticator) grant(ctx context.Context, cur *jwtToken, params url.Values) (*jwtToken, error) {
+	if t.deviceAuth != nil {
+		if cur == nil || cur.RefreshToken == "" {
+			return nil, ErrLoginRequired
 		}
-
-		if !found {
-			return nil, errors.New("public JWK not found")
+		tk, err := t.token(ctx, cur, params)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrLoginRequired, err)
 		}
+		return tk, nil
+	}
+
+	tk, err := t.token(ctx, cur, params)
+	if err != nil && cur != nil && cur.RefreshToken != "" {
+		// The refresh token may be expired/revoked; re-authenticate from scratch.
+		t.observer.OnFallback(FallbackEvent{Err: err})
+		tk, err = t.token(ctx, nil, params)
 	}
+	return tk, err
+}
+
+// refreshInterval returns how long to wait before refreshing the current token.
+func (t *Authenticator) refreshInterval() time.Duration {
+	return t.refreshAfter(t.tk.Load())
+}
 
-	if !publicJWK.IsPublic() {
-		return nil, errors.New("JWK is not public key")
+// refreshAfter schedules the refresh of tk at refreshRatio (~80%) of the token's
+// lifetime so the margin scales with short-lived tokens instead of a fixed
+// offset that could exceed the TTL. The lifetime is counted from issuance, so a
+// token adopted from a TokenStore is refreshed on the same schedule by every
+// replica.
+func (t *Authenticator) refreshAfter(tk *jwtToken) time.Duration {
+	if tk == nil || tk.ExpireIn <= 0 {
+		return time.Minute
 	}
 
-	key, ok := publicJWK.Key.(*rsa.PublicKey)
-	if !ok {
-		return nil, errors.New("JWK is not an RSA public key")
+	d := time.Duration(tk.ExpireIn) * time.Second
+	if tk.expiresAt.IsZero() {
+		return time.Duration(float64(d) * t.refreshRatio)
 	}
 
-	return key, nil
+	return max(time.Until(tk.refreshAt(t.refreshRatio)), time.Second)
 }
@@ -0,0 +1,138 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// ErrInsufficientScope is wrapped by the errors of a Requirement the claims do not
+// meet.
+var ErrInsufficientScope = errors.New("insufficient scope")
+
+// Requirement is an authorization check on verified claims. It returns nil when
+// the claims meet it and otherwise an error wrapping ErrInsufficientScope. Call it
+// directly on claims, or use its Middleware behind Authenticate.
+type Requirement func(claims *Claims) error
+
+// Middleware returns middleware that applies req to the claims put on the request
+// context by Authenticate. Requests without claims get 401, requests whose claims
+// do not meet req get 403 with an insufficient_scope challenge (RFC 6750).
+func (req Requirement) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims, ok := ClaimsFromContext(r.Context())
+		if !ok {
+			writeBearerChallenge(w, http.StatusUnauthorized, "", "")
+			return
+		}
+
+		if err := req(claims); err != nil {
+			writeBearerChallenge(w, http.StatusForbidden, "insufficient_scope", err.Error())
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// RequireScopes requires every one of scopes to be granted by the scope claim.
+func RequireScopes(scopes ...string) Requirement {
+	return func(claims *Claims) error {
+		granted := claims.Scopes()
+		for _, scope := range scopes {
+			if !slices.Contains(granted, scope) {
+				return fmt.Errorf("%w: scope %q is required", ErrInsufficientScope, scope)
+			}
+		}
+		return nil
+	}
+}
+
+// RequireAnyRole requires at least one of roles at DefaultRolePaths.
+func RequireAnyRole(roles ...string) Requirement {
+	return DefaultRolePaths.RequireAny(roles...)
+}
+
+// Require requires pred to hold for the claims. description says what is
+// required; it is sent back to the client when pred does not hold.
+func Require(description string, pred func(claims *Claims) bool) Requirement {
+	return func(claims *Claims) error {
+		if !pred(claims) {
+			return fmt.Errorf("%w: %s", ErrInsufficientScope, description)
+		}
+		return nil
+	}
+}
+
+// Scopes returns the space separated scope claim as a list.
+func (c *Claims) Scopes() []string {
+	return strings.Fields(c.Scope)
+}
+
+// RolePaths are the claims roles are read from. Each path names a claim holding a
+// string or a list of strings, nested objects separated by dots, e.g.
+// realm_access.roles. Claim names containing dots, such as the namespaced claims
+// Auth0 uses, match as a whole, so https://example.com/roles works too.
+type RolePaths []string
+
+// DefaultRolePaths are used by RequireAnyRole: a top-level roles claim and
+// Keycloak's realm roles. Keycloak client roles live at
+// resource_access.<client>.roles.
+var DefaultRolePaths = RolePaths{"roles", "realm_access.roles"}
+
+// Roles returns the roles found at p in claims.
+func (p RolePaths) Roles(claims *Claims) []string {
+	var roles []string
+	for _, path := range p {
+		switch v := claimAt(claims.Raw, path).(type) {
+		case string:
+			roles = append(roles, v)
+		case []any:
+			for _, role := range v {
+				if s, ok := role.(string); ok {
+					roles = append(roles, s)
+				}
+			}
+		}
+	}
+	return roles
+}
+
+// RequireAny requires at least one of roles at p.
+func (p RolePaths) RequireAny(roles ...string) Requirement {
+	return func(claims *Claims) error {
+		if slices.ContainsFunc(p.Roles(claims), func(role string) bool { return slices.Contains(roles, role) }) {
+			return nil
+		}
+		return fmt.Errorf("%w: one of roles %q is required", ErrInsufficientScope, roles)
+	}
+}
+
+// claimAt returns the value at the dot separated path in claims, or nil. At each
+// level the longest matching claim name wins, so names may contain dots.
+func claimAt(claims map[string]any, path string) any {
+	parts := strings.Split(path, ".")
+
+	var cur any = claims
+	for len(parts) > 0 {
+		obj, ok := cur.(map[string]any)
+		if !ok {
+			return nil
+		}
+
+		found := false
+		for n := len(parts); n > 0; n-- {
+			if v, ok := obj[strings.Join(parts[:n], ".")]; ok {
+				cur, parts, found = v, parts[n:], true
+				break
+			}
+		}
+		if !found {
+			return nil
+		}
+	}
+
+	return cur
+}
@@ -0,0 +1,112 @@
+package service
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// ttlCache is a bounded LRU cache whose entries also expire at their own time.
+// When full, the least recently used entry is dropped.
+type ttlCache[V any] struct {
+	size int
+
+	mu    sync.Mutex
+	ll    *list.List
+	items map[string]*list.Element
+}
+
+type ttlEntry[V any] struct {
+	key       string
+	value     V
+	expiresAt time.Time
+}
+
+func newTTLCache[V any](size int) *ttlCache[V] {
+	return &ttlCache[V]{
+		size:  size,
+		ll:    list.New(),
+		items: map[string]*list.Element{},
+	}
+}
+
+// get returns the value for key unless it is missing or expired at now.
+func (c *ttlCache[V]) get(key string, now time.Time) (V, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var zero V
+
+	el, ok := c.items[key]
+	if !ok {
+		return zero, false
+	}
+
+	entry := el.Value.(*ttlEntry[V])
+	if !now.Before(entry.expiresAt) {
+		c.ll.Remove(el)
+		delete(c.items, key)
+		return zero, false
+	}
+
+	c.ll.MoveToFront(el)
+
+	return entry.value, true
+}
+
+// set stores value for key until expiresAt.
+func (c *ttlCache[V]) set(key string, value V, expiresAt time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.store(key, value, expiresAt)
+}
+
+// add stores value for key until expiresAt unless key holds an entry that has
+// not expired at now. It reports whether value was stored.
+func (c *ttlCache[V]) add(key string, value V, now, expiresAt time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.items[key]; ok && now.Before(el.Value.(*ttlEntry[V]).expiresAt) {
+		return false
+	}
+
+	c.store(key, value, expiresAt)
+
+	return true
+}
+
+// store must be called with mu held.
+func (c *ttlCache[V]) store(key string, value V, expiresAt time.Time) {
+	if el, ok := c.items[key]; ok {
+		el.Value = &ttlEntry[V]{key: key, value: value, expiresAt: expiresAt}
+		c.ll.MoveToFront(el)
+		return
+	}
+
+	c.items[key] = c.ll.PushFront(&ttlEntry[V]{key: key, value: value, expiresAt: expiresAt})
+
+	for c.ll.Len() > c.size {
+		oldest := c.ll.Back()
+		c.ll.Remove(oldest)
+		delete(c.items, oldest.Value.(*ttlEntry[V]).key)
+	}
+}
+
+// len returns the number of entries, including expired ones not yet dropped.
+func (c *ttlCache[V]) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.ll.Len()
+}
+
+// clear drops every entry.
+func (c *ttlCache[V]) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.ll.Init()
+	clear(c.items)
+}
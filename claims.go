@@ -0,0 +1,97 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/go-jose/go-jose/v4/jwt"
+)
+
+// DefaultLeeway is the clock skew tolerated when checking exp, nbf and iat.
+const DefaultLeeway = time.Minute
+
+var (
+	ErrTokenExpired        = errors.New("token is expired")
+	ErrTokenNotYetValid    = errors.New("token is not valid yet")
+	ErrTokenWrongAudience  = errors.New("token has wrong audience")
+	ErrTokenWrongIssuer    = errors.New("token has wrong issuer")
+	ErrTokenInvalidPayload = errors.New("token payload is not a valid claims set")
+	ErrTokenMalformed      = errors.New("token is malformed")
+)
+
+// Claims are the registered JWT claims (RFC 7519, section 4.1) of a verified token,
+// along with the scope and client_id claims shared by access tokens and
+// introspection responses (RFC 9068, RFC 7662).
+type Claims struct {
+	Issuer    string           `json:"iss,omitempty"`
+	Subject   string           `json:"sub,omitempty"`
+	Audience  jwt.Audience     `json:"aud,omitempty"`
+	Expiry    *jwt.NumericDate `json:"exp,omitempty"`
+	NotBefore *jwt.NumericDate `json:"nbf,omitempty"`
+	IssuedAt  *jwt.NumericDate `json:"iat,omitempty"`
+	ID        string           `json:"jti,omitempty"`
+
+	Scope    string `json:"scope,omitempty"`
+	ClientID string `json:"client_id,omitempty"`
+
+	// Raw holds every claim of the token, including the ones above, as decoded
+	// from JSON. It is shared between callers and must not be modified.
+	Raw map[string]any `json:"-"`
+}
+
+// UnmarshalJSON decodes the registered claims and keeps all of them in Raw.
+func (c *Claims) UnmarshalJSON(data []byte) error {
+	type claims Claims
+	if err := json.Unmarshal(data, (*claims)(c)); err != nil {
+		return err
+	}
+	return json.Unmarshal(data, &c.Raw)
+}
+
+// decodeClaims decodes the claims in a verified payload, validates them like
+// validateClaims, and decodes payload into custom when it is not nil.
+func decodeClaims(payload []byte, custom any, leeway time.Duration, issuers, audiences []string) (*Claims, error) {
+	claims := &Claims{}
+	if err := json.Unmarshal(payload, claims); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrTokenInvalidPayload, err)
+	}
+
+	if err := validateClaims(claims, time.Now(), leeway, issuers, audiences); err != nil {
+		return nil, err
+	}
+
+	if custom != nil {
+		if err := json.Unmarshal(payload, custom); err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrTokenInvalidPayload, err)
+		}
+	}
+
+	return claims, nil
+}
+
+// validateClaims checks the time-based claims with the given leeway and, when
+// issuers or audiences are not empty, that the token matches one of them.
+func validateClaims(c *Claims, now time.Time, leeway time.Duration, issuers, audiences []string) error {
+	if c.Expiry != nil && now.Add(-leeway).After(c.Expiry.Time()) {
+		return ErrTokenExpired
+	}
+	if c.NotBefore != nil && now.Add(leeway).Before(c.NotBefore.Time()) {
+		return ErrTokenNotYetValid
+	}
+	if c.IssuedAt != nil && now.Add(leeway).Before(c.IssuedAt.Time()) {
+		return fmt.Errorf("%w: issued in the future", ErrTokenNotYetValid)
+	}
+
+	if len(issuers) > 0 && !slices.Contains(issuers, c.Issuer) {
+		return fmt.Errorf("%w: %q", ErrTokenWrongIssuer, c.Issuer)
+	}
+
+	if len(audiences) > 0 && !slices.ContainsFunc(audiences, c.Audience.Contains) {
+		return fmt.Errorf("%w: %q", ErrTokenWrongAudience, []string(c.Audience))
+	}
+
+	return nil
+}
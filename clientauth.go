@@ -0,0 +1,162 @@
+package service
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+)
+
+// ClientAuthMethod is how the Authenticator authenticates itself to the auth
+// service (RFC 6749, section 2.3 and OpenID Connect Core, section 9).
+type ClientAuthMethod string
+
+const (
+	// ClientSecretPost sends client_id and client_secret in the form body.
+	ClientSecretPost ClientAuthMethod = "client_secret_post"
+	// ClientSecretBasic sends client_id and client_secret as HTTP Basic credentials.
+	ClientSecretBasic ClientAuthMethod = "client_secret_basic"
+	// PrivateKeyJWT sends a JWT assertion signed with the client's private key
+	// (RFC 7523), so no shared secret is needed.
+	PrivateKeyJWT ClientAuthMethod = "private_key_jwt"
+	// ClientNone sends only client_id, for public clients such as CLIs logging in
+	// with DeviceAuthorization, which cannot keep a secret.
+	ClientNone ClientAuthMethod = "none"
+)
+
+const (
+	clientAssertionType = "urn:ietf:params:oauth:client-assertion-type:jwt-bearer"
+	clientAssertionTTL  = time.Minute
+)
+
+var (
+	ErrAuthPrivateKeyNotFound = errors.New("private key for private_key_jwt not found")
+	ErrUnsupportedAuthMethod  = errors.New("unsupported client authentication method")
+)
+
+// clientAuth adds the client's credentials for a request to endpoint, either to
+// the form data or as a Basic Authorization header.
+func (t *Authenticator) clientAuth(endpoint string, data url.Values, header http.Header) error {
+	switch t.authMethod {
+	case ClientSecretBasic:
+		// RFC 6749, section 2.3.1: both parts are form-encoded before base64.
+		credentials := url.QueryEscape(t.ClientID) + ":" + url.QueryEscape(t.ClientSecret)
+		header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(credentials)))
+	case PrivateKeyJWT:
+		assertion, err := t.clientAssertion(endpoint)
+		if err != nil {
+			return fmt.Errorf("failed to sign client assertion: %w", err)
+		}
+		data.Set("client_id", t.ClientID)
+		data.Set("client_assertion_type", clientAssertionType)
+		data.Set("client_assertion", assertion)
+	case ClientNone:
+		data.Set("client_id", t.ClientID)
+	default:
+		data.Set("client_id", t.ClientID)
+		data.Set("client_secret", t.ClientSecret)
+	}
+
+	return nil
+}
+
+// clientAssertion returns a short-lived JWT identifying the client to audience,
+// as described in RFC 7523, section 3.
+func (t *Authenticator) clientAssertion(audience string) (string, error) {
+	now := time.Now()
+
+	return jwt.Signed(t.assertionSigner).Claims(jwt.Claims{
+		Issuer:   t.ClientID,
+		Subject:  t.ClientID,
+		Audience: jwt.Audience{audience},
+		ID:       UUID(),
+		IssuedAt: jwt.NewNumericDate(now),
+		Expiry:   jwt.NewNumericDate(now.Add(clientAssertionTTL)),
+	}).Serialize()
+}
+
+// newAssertionSigner builds the signer for private_key_jwt assertions. When alg
+// is empty it is derived from the key type.
+func newAssertionSigner(key crypto.Signer, keyID string, alg jose.SignatureAlgorithm) (jose.Signer, error) {
+	if alg == "" {
+		alg = defaultAlgorithm(key)
+		if alg == "" {
+			return nil, fmt.Errorf("unsupported private key type %T", key)
+		}
+	}
+
+	opts := (&jose.SignerOptions{}).WithType("JWT")
+	if keyID != "" {
+		opts = opts.WithHeader(jose.HeaderKey("kid"), keyID)
+	}
+
+	return jose.NewSigner(jose.SigningKey{Algorithm: alg, Key: key}, opts)
+}
+
+// defaultAlgorithm returns the usual signature algorithm for key, or an empty
+// string when the key type is not supported.
+func defaultAlgorithm(key crypto.Signer) jose.SignatureAlgorithm {
+	switch k := key.Public().(type) {
+	case *rsa.PublicKey:
+		return jose.RS256
+	case *ecdsa.PublicKey:
+		switch k.Curve {
+		case elliptic.P256():
+			return jose.ES256
+		case elliptic.P384():
+			return jose.ES384
+		case elliptic.P521():
+			return jose.ES512
+		}
+	case ed25519.PublicKey:
+		return jose.EdDSA
+	}
+	return ""
+}
+
+// LoadPrivateKey reads a PEM encoded RSA, EC or Ed25519 private key in PKCS #8,
+// PKCS #1 or SEC 1 form.
+func LoadPrivateKey(path string) (crypto.Signer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM data found", path)
+	}
+
+	var key any
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("%s: unsupported private key type %T", path, key)
+	}
+
+	return signer, nil
+}
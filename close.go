@@ -0,0 +1,101 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+)
+
+// Close stops the background refreshers and waits for them to exit, or for ctx to
+// be done. When RevokeOnClose is configured it then revokes the held refresh and
+// access tokens, including those obtained with TokenFor, at the revocation
+// endpoint (RFC 7009), so they do not outlive the process. After Close, Token,
+// TokenFor and the other methods keep working, fetching tokens on demand without
+// refreshing them in the background. If ctx is done before Close finished, the
+// tokens are not revoked and Close can be called again to complete; once it has
+// completed, calling it again is a no-op.
+func (t *Authenticator) Close(ctx context.Context) error {
+	t.closeOnce.Do(func() {
+		t.scopedMu.Lock()
+		t.closed = true
+		t.scopedMu.Unlock()
+
+		t.cancel()
+	})
+
+	t.closeMu.Lock()
+	defer t.closeMu.Unlock()
+
+	if t.closeDone {
+		return nil
+	}
+
+	done := make(chan struct{})
+	go func() {
+		t.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+	}
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("waiting for refreshers, tokens not revoked: %w", err)
+	}
+
+	var err error
+	if t.revoke {
+		err = t.revokeAll(ctx)
+		if ctx.Err() != nil {
+			// Interrupted by the caller; let a retried Close revoke again.
+			return err
+		}
+	}
+
+	t.client.CloseIdleConnections()
+	t.jwks.client.CloseIdleConnections()
+	t.closeDone = true
+
+	return err
+}
+
+// revokeAll revokes the main token and every scoped token. Refresh tokens are
+// revoked first, as revoking one usually invalidates its access tokens too.
+func (t *Authenticator) revokeAll(ctx context.Context) error {
+	tokens := []*jwtToken{t.tk.Load()}
+
+	t.scopedMu.Lock()
+	for _, entry := range t.scoped {
+		tokens = append(tokens, entry.tk.Load())
+	}
+	t.scopedMu.Unlock()
+
+	var errs []error
+	for _, tk := range tokens {
+		if tk == nil {
+			continue
+		}
+		if tk.RefreshToken != "" {
+			errs = append(errs, t.revokeToken(ctx, tk.RefreshToken, "refresh_token"))
+		}
+		errs = append(errs, t.revokeToken(ctx, tk.AccessToken, "access_token"))
+	}
+
+	return errors.Join(errs...)
+}
+
+// revokeToken asks the revocation endpoint to invalidate token.
+func (t *Authenticator) revokeToken(ctx context.Context, token, hint string) error {
+	data := url.Values{}
+	data.Set("token", token)
+	data.Set("token_type_hint", hint)
+
+	resp, err := t.postForm(ctx, t.RevocationEndpoint, data)
+	if err != nil {
+		return fmt.Errorf("revoke %s: %w", hint, err)
+	}
+
+	return resp.Body.Close()
+}
@@ -0,0 +1,210 @@
+package service
+
+import (
+	"cmp"
+	"context"
+	"crypto"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+)
+
+const (
+	defaultAuthTimeout  = time.Minute
+	defaultJWKSTimeout  = 3 * time.Second
+	defaultRefreshRatio = 0.8
+
+	defaultTokenIdleTimeout = 30 * time.Minute
+)
+
+// AuthConfig configures an Authenticator created with NewAuthenticatorWithConfig.
+// Only Host (or both TokenEndpoint and JWKSURI), ClientID and ClientSecret (or a
+// private key for PrivateKeyJWT) are required; every other field has a sensible
+// default.
+type AuthConfig struct {
+	Host         string
+	ClientID     string
+	ClientSecret string
+
+	// TokenEndpoint and JWKSURI override the endpoints otherwise discovered from
+	// Host's /.well-known/openid-configuration.
+	TokenEndpoint string
+	JWKSURI       string
+	// IntrospectionEndpoint and RevocationEndpoint override the discovered RFC 7662
+	// and RFC 7009 endpoints.
+	IntrospectionEndpoint string
+	RevocationEndpoint    string
+	// KeyID pins token verification to the JWK with this kid.
+	KeyID string
+
+	// AuthMethod selects how the client authenticates at the token endpoint;
+	// ClientSecretPost by default. PrivateKeyJWT needs PrivateKey or
+	// PrivateKeyFile instead of ClientSecret.
+	AuthMethod ClientAuthMethod
+	// PrivateKey signs private_key_jwt assertions. PrivateKeyFile is a PEM file
+	// read when PrivateKey is nil. PrivateKeyID is sent as the assertion's kid and
+	// PrivateKeyAlgorithm defaults to RS256, ES256/384/512 or EdDSA by key type.
+	PrivateKey          crypto.Signer
+	PrivateKeyFile      string
+	PrivateKeyID        string
+	PrivateKeyAlgorithm jose.SignatureAlgorithm
+
+	// Scopes are requested with every client_credentials grant.
+	Scopes []string
+
+	// Issuers, Audiences, Leeway and Algorithms seed the Authenticator fields of
+	// the same name.
+	Issuers    []string
+	Audiences  []string
+	Leeway     time.Duration
+	Algorithms []jose.SignatureAlgorithm
+
+	// VerifyMode selects JWT verification, introspection or picking by the token's
+	// shape in VerifyClaims. IntrospectionCacheTTL (one minute by default) and
+	// IntrospectionCacheSize (1024 when not positive) bound the cache of active
+	// introspection results.
+	VerifyMode             VerifyMode
+	IntrospectionCacheTTL  time.Duration
+	IntrospectionCacheSize int
+
+	// VerifyCacheSize enables a cache of up to this many verified tokens, kept by
+	// hash until their exp, so Verify and VerifyClaims skip the signature check
+	// for tokens seen before. It is cleared when the JWKS changes. Disabled when
+	// zero, the default.
+	VerifyCacheSize int
+
+	// HTTPClient is used for token requests. Its Transport is also used for
+	// discovery and JWKS requests, so custom TLS roots apply everywhere. When nil
+	// a client with Timeout is created.
+	HTTPClient *http.Client
+	// Timeout bounds token requests when HTTPClient is nil; one minute by default.
+	Timeout time.Duration
+	// JWKSTimeout bounds discovery and JWKS requests; three seconds by default.
+	JWKSTimeout time.Duration
+
+	// RefreshRatio is the fraction of a token's lifetime after which it is
+	// refreshed in the background; 0.8 by default.
+	RefreshRatio float64
+	// RetryMin and RetryMax bound the wait before retrying a failed refresh. The
+	// wait doubles with each consecutive failure, from RetryMin (one second by
+	// default) up to RetryMax (one minute by default), and is randomized so that
+	// replicas do not retry in lockstep.
+	RetryMin time.Duration
+	RetryMax time.Duration
+	// MaxStaleness is how long after expiry TokenContext keeps returning the held
+	// token when it cannot be refreshed. Zero, the default, fails right away.
+	MaxStaleness time.Duration
+	// TokenIdleTimeout is how long a token obtained with TokenFor is kept and
+	// refreshed without being asked for; 30 minutes by default.
+	TokenIdleTimeout time.Duration
+	// TokenStore shares the service token between replicas, so only one of them
+	// runs a grant at a time and the others reuse its result. See
+	// NewRedisTokenStore and NewFileTokenStore.
+	TokenStore TokenStore
+
+	// Observer receives grant, JWKS and verification events, e.g. an
+	// ExpvarObserver to publish them as metrics.
+	Observer Observer
+
+	// DeviceAuthorization makes the Authenticator act for a user, e.g. in a CLI.
+	// Instead of the client_credentials grant it logs in with the RFC 8628 device
+	// authorization grant: DeviceAuthorization is called with the code to show to
+	// the user (see PrintDeviceCode) while the token endpoint is polled until the
+	// user approves. The tokens are then refreshed like any other. Without a
+	// ClientSecret the client is public and AuthMethod defaults to ClientNone.
+	// With a TokenStore, such as a FileTokenStore in the user's cache directory,
+	// the tokens outlive the process, so users do not log in on every run.
+	DeviceAuthorization func(ctx context.Context, code DeviceCode) error
+	// DeviceAuthorizationEndpoint overrides the discovered device authorization
+	// endpoint.
+	DeviceAuthorizationEndpoint string
+
+	// DPoP binds the tokens to a key pair generated for the Authenticator (RFC
+	// 9449), so a leaked token is useless without the key. Token requests carry
+	// DPoP proofs of the key, and Transport sends the tokens with a fresh proof per
+	// request, retrying once when a server asks for a nonce. Tokens handed out by
+	// Token, TokenFor and Exchange need a proof too; see DPoPProof. DPoP cannot be
+	// combined with TokenStore, as the key never leaves the process, and the gRPC
+	// client interceptors refuse to send the bound tokens.
+	DPoP bool
+
+	// InsecureRPC lets the gRPC client interceptors send tokens over connections
+	// without transport security, e.g. inside a service mesh whose sidecars
+	// encrypt the traffic. By default they require TLS, like grpc-go's oauth
+	// credentials.
+	InsecureRPC bool
+
+	// RevokeOnClose makes Close revoke the held refresh and access tokens.
+	RevokeOnClose bool
+	// ExchangeCacheSize bounds the number of tokens cached by Exchange; 1024 when
+	// not positive.
+	ExchangeCacheSize int
+}
+
+// AuthArgs - authenticator arguments. Can be embedded next to ARGS and passed to
+// Init or ParseEnv, then turned into an AuthConfig with Config.
+type AuthArgs struct {
+	AuthHost         string        `long:"auth-host" env:"AUTH_HOST" description:"auth service host"`
+	AuthClientID     string        `long:"auth-client-id" env:"AUTH_CLIENT_ID" description:"auth client id"`
+	AuthClientSecret string        `long:"auth-client-secret" env:"AUTH_CLIENT_SECRET" description:"auth client secret"`
+	AuthTokenURL     string        `long:"auth-token-endpoint" env:"AUTH_TOKEN_ENDPOINT" description:"token endpoint, discovered when empty"`
+	AuthJWKSURI      string        `long:"auth-jwks-uri" env:"AUTH_JWKS_URI" description:"JWKS endpoint, discovered when empty"`
+	AuthKeyID        string        `long:"jwks-key-id" env:"JWKS_KEY_ID" description:"pin token verification to this JWK kid"`
+	AuthMethod       string        `long:"auth-method" env:"AUTH_METHOD" default:"client_secret_post" choice:"client_secret_post" choice:"client_secret_basic" choice:"private_key_jwt" choice:"none" description:"client authentication method"`
+	AuthPrivateKey   string        `long:"auth-private-key" env:"AUTH_PRIVATE_KEY" description:"PEM private key file for private_key_jwt"`
+	AuthPrivateKeyID string        `long:"auth-private-key-id" env:"AUTH_PRIVATE_KEY_ID" description:"kid of the private_key_jwt key"`
+	AuthScopes       []string      `long:"auth-scope" env:"AUTH_SCOPES" env-delim:" " description:"scopes requested for the service token"`
+	AuthAudiences    []string      `long:"auth-audience" env:"AUTH_AUDIENCES" env-delim:"," description:"accepted token audiences separated by ,"`
+	AuthVerifyMode   string        `long:"auth-verify-mode" env:"AUTH_VERIFY_MODE" default:"jwt" choice:"jwt" choice:"introspect" choice:"auto" description:"how incoming tokens are verified"`
+	AuthRevoke       bool          `long:"auth-revoke-on-close" env:"AUTH_REVOKE_ON_CLOSE" description:"revoke held tokens on shutdown"`
+	AuthTimeout      time.Duration `long:"auth-timeout" env:"AUTH_TIMEOUT" default:"1m" description:"auth service request timeout"`
+}
+
+// Config returns the AuthConfig described by the arguments.
+func (a AuthArgs) Config() AuthConfig {
+	return AuthConfig{
+		Host:           a.AuthHost,
+		ClientID:       a.AuthClientID,
+		ClientSecret:   a.AuthClientSecret,
+		TokenEndpoint:  a.AuthTokenURL,
+		JWKSURI:        a.AuthJWKSURI,
+		KeyID:          a.AuthKeyID,
+		AuthMethod:     ClientAuthMethod(a.AuthMethod),
+		PrivateKeyFile: a.AuthPrivateKey,
+		PrivateKeyID:   a.AuthPrivateKeyID,
+		Scopes:         a.AuthScopes,
+		Audiences:      a.AuthAudiences,
+		Timeout:        a.AuthTimeout,
+		VerifyMode:     verifyModes[a.AuthVerifyMode],
+		RevokeOnClose:  a.AuthRevoke,
+	}
+}
+
+// authConfigFromEnv reads the variables NewAuthenticator has always supported.
+func authConfigFromEnv() AuthConfig {
+	return AuthConfig{
+		Host:          os.Getenv("AUTH_HOST"),
+		ClientID:      os.Getenv("AUTH_CLIENT_ID"),
+		ClientSecret:  os.Getenv("AUTH_CLIENT_SECRET"),
+		TokenEndpoint: os.Getenv("AUTH_TOKEN_ENDPOINT"),
+		JWKSURI:       os.Getenv("AUTH_JWKS_URI"),
+		KeyID:         os.Getenv("JWKS_KEY_ID"),
+
+		AuthMethod:     ClientAuthMethod(os.Getenv("AUTH_METHOD")),
+		PrivateKeyFile: os.Getenv("AUTH_PRIVATE_KEY"),
+		PrivateKeyID:   os.Getenv("AUTH_PRIVATE_KEY_ID"),
+	}
+}
+
+// httpClients returns the client for token requests and the one for discovery
+// and JWKS requests.
+func (c *AuthConfig) httpClients() (token, meta *http.Client) {
+	token = c.HTTPClient
+	if token == nil {
+		token = &http.Client{Timeout: cmp.Or(c.Timeout, defaultAuthTimeout)}
+	}
+
+	return token, &http.Client{Transport: token.Transport, Timeout: cmp.Or(c.JWKSTimeout, defaultJWKSTimeout)}
+}
@@ -0,0 +1,213 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"time"
+)
+
+const (
+	deviceCodeGrant = "urn:ietf:params:oauth:grant-type:device_code"
+
+	// defaultRefreshTokenTTL is how long a user's tokens are kept in the
+	// TokenStore when the server does not say when the refresh token expires.
+	defaultRefreshTokenTTL = 30 * 24 * time.Hour
+)
+
+// deviceInterval is the polling interval when the server sends none, and the
+// increment on slow_down (RFC 8628, section 3.5).
+var deviceInterval = 5 * time.Second
+
+var (
+	// ErrLoginRequired is returned when a user's tokens obtained with
+	// DeviceAuthorization can no longer be refreshed. Login starts over.
+	ErrLoginRequired = errors.New("login required")
+	// ErrDeviceAccessDenied is returned when the user denies the device
+	// authorization request.
+	ErrDeviceAccessDenied = errors.New("device authorization denied")
+	// ErrDeviceCodeExpired is returned when the user does not approve the device
+	// authorization request before the device code expires.
+	ErrDeviceCodeExpired = errors.New("device code expired")
+)
+
+// DeviceCode is the device authorization response (RFC 8628, section 3.2). The
+// user approves the request by visiting VerificationURI and entering UserCode,
+// or by visiting VerificationURIComplete when the server sends it.
+type DeviceCode struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationURI         string `json:"verification_uri"`
+	VerificationURIComplete string `json:"verification_uri_complete,omitempty"`
+	// ExpiresIn and Interval are in seconds.
+	ExpiresIn int `json:"expires_in"`
+	Interval  int `json:"interval,omitempty"`
+}
+
+// PrintDeviceCode returns a DeviceAuthorization function that tells the user, on
+// w, where to go and which code to enter.
+func PrintDeviceCode(w io.Writer) func(ctx context.Context, code DeviceCode) error {
+	return func(_ context.Context, code DeviceCode) error {
+		if code.VerificationURIComplete != "" {
+			_, err := fmt.Fprintf(w, "To log in, open %s and confirm the code %s\n", code.VerificationURIComplete, code.UserCode)
+			return err
+		}
+		_, err := fmt.Fprintf(w, "To log in, open %s and enter the code %s\n", code.VerificationURI, code.UserCode)
+		return err
+	}
+}
+
+// Login logs the user in again with the device authorization grant and replaces
+// the held tokens, and those in the TokenStore. Use it for a login command, or
+// after an error wrapping ErrLoginRequired. It requires DeviceAuthorization.
+func (t *Authenticator) Login(ctx context.Context) error {
+	if t.deviceAuth == nil {
+		return errors.New("device authorization is not configured")
+	}
+
+	err := t.login(ctx, false)
+	if err == nil || ctx.Err() == nil {
+		t.recordRefresh(err)
+	}
+	return err
+}
+
+// login obtains the user's tokens. With cached, tokens left in the TokenStore by
+// a previous run are used when still valid, or refreshed when their refresh token
+// still works, before falling back to the device flow.
+func (t *Authenticator) login(ctx context.Context, cached bool) error {
+	if err := t.refreshMu.lock(ctx); err != nil {
+		return err
+	}
+	defer t.refreshMu.unlock()
+
+	if cached && t.store != nil {
+		if stored := t.loadShared(ctx); stored != nil {
+			if !stored.expired() {
+				t.tk.Store(stored)
+				return nil
+			}
+
+			if stored.RefreshToken != "" {
+				tk, err := t.token(ctx, stored, t.grantParams)
+				if err == nil {
+					t.tk.Store(tk)
+					t.saveShared(ctx, tk)
+					return nil
+				}
+				log.Printf("[WARN] failed to refresh stored token, logging in again: %v", err)
+			}
+		}
+	}
+
+	code, err := t.authorizeDevice(ctx)
+	if err != nil {
+		return err
+	}
+
+	if err := t.deviceAuth(ctx, *code); err != nil {
+		return err
+	}
+
+	tk, err := t.pollDevice(ctx, code)
+	if err != nil {
+		return err
+	}
+
+	t.tk.Store(tk)
+	if t.store != nil {
+		t.saveShared(ctx, tk)
+	}
+
+	return nil
+}
+
+// authorizeDevice requests a device code for the configured scopes.
+func (t *Authenticator) authorizeDevice(ctx context.Context) (*DeviceCode, error) {
+	data := url.Values{}
+	for k, v := range t.grantParams {
+		data[k] = v
+	}
+
+	resp, err := t.postForm(ctx, t.DeviceAuthorizationEndpoint, data)
+	if err != nil {
+		return nil, fmt.Errorf("device authorization: %w", err)
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	code := &DeviceCode{}
+	if err := json.NewDecoder(resp.Body).Decode(code); err != nil {
+		return nil, fmt.Errorf("failed to decode device authorization response: %w", err)
+	}
+	if code.DeviceCode == "" || code.UserCode == "" || code.VerificationURI == "" {
+		return nil, errors.New("device authorization response is incomplete")
+	}
+
+	return code, nil
+}
+
+// pollDevice polls the token endpoint until the user approved or denied code, or
+// code expired. The interval grows on slow_down as RFC 8628 requires.
+func (t *Authenticator) pollDevice(ctx context.Context, code *DeviceCode) (tk *jwtToken, err error) {
+	start := time.Now()
+	defer func() {
+		t.observer.OnGrant(GrantEvent{GrantType: deviceCodeGrant, Duration: time.Since(start), Err: err})
+	}()
+
+	interval := deviceInterval
+	if code.Interval > 0 {
+		interval = time.Duration(code.Interval) * time.Second
+	}
+
+	var expired <-chan time.Time
+	if code.ExpiresIn > 0 {
+		timer := time.NewTimer(time.Duration(code.ExpiresIn) * time.Second)
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	for {
+		select {
+		case <-time.After(interval):
+		case <-expired:
+			return nil, ErrDeviceCodeExpired
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+
+		data := url.Values{}
+		data.Set("grant_type", deviceCodeGrant)
+		data.Set("device_code", code.DeviceCode)
+
+		resp, err := t.postForm(ctx, t.TokenEndpoint, data)
+		if err == nil {
+			defer func() {
+				_ = resp.Body.Close()
+			}()
+			return decodeToken(resp.Body)
+		}
+
+		var oerr *oauthError
+		if !errors.As(err, &oerr) {
+			return nil, err
+		}
+
+		switch oerr.Code {
+		case "authorization_pending":
+		case "slow_down":
+			interval += deviceInterval
+		case "access_denied":
+			return nil, fmt.Errorf("%w: %w", ErrDeviceAccessDenied, err)
+		case "expired_token":
+			return nil, fmt.Errorf("%w: %w", ErrDeviceCodeExpired, err)
+		default:
+			return nil, err
+		}
+	}
+}
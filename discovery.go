@@ -0,0 +1,103 @@
+package service
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// errDiscoveryUnavailable reports that the auth service does not publish OpenID
+// Connect discovery metadata, in which case the conventional endpoints are used.
+var errDiscoveryUnavailable = errors.New("openid configuration not available")
+
+// providerMetadata is the subset of the OpenID Connect discovery document
+// (OpenID Connect Discovery 1.0, section 3) the Authenticator uses.
+type providerMetadata struct {
+	Issuer        string `json:"issuer"`
+	TokenEndpoint string `json:"token_endpoint"`
+	JWKSURI       string `json:"jwks_uri"`
+
+	IntrospectionEndpoint string `json:"introspection_endpoint"`
+	RevocationEndpoint    string `json:"revocation_endpoint"`
+
+	DeviceAuthorizationEndpoint string `json:"device_authorization_endpoint"`
+}
+
+// discover reads host's /.well-known/openid-configuration. It returns
+// errDiscoveryUnavailable when the server does not answer with a JSON document,
+// e.g. 404, 403 from a gateway or an HTML fallback page, so servers without
+// discovery keep working with the default endpoints. Only transport errors fail.
+func discover(ctx context.Context, client *http.Client, host string) (*providerMetadata, error) {
+	uri := strings.TrimSuffix(host, "/") + "/.well-known/openid-configuration"
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, uri, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound, http.StatusMethodNotAllowed, http.StatusNotImplemented:
+		return nil, errDiscoveryUnavailable
+	default:
+		log.Printf("[WARN] openid discovery at %s answered %d (%s), using default endpoints", uri, resp.StatusCode, http.StatusText(resp.StatusCode))
+		return nil, errDiscoveryUnavailable
+	}
+
+	meta := &providerMetadata{}
+	if err := json.NewDecoder(resp.Body).Decode(meta); err != nil {
+		log.Printf("[WARN] failed to decode openid configuration from %s, using default endpoints: %v", uri, err)
+		return nil, errDiscoveryUnavailable
+	}
+
+	return meta, nil
+}
+
+// resolveEndpoints fills the endpoints that were not set explicitly, preferring
+// the discovery document and falling back to the conventional paths under Host.
+// Discovery is skipped when the token and JWKS endpoints are both configured.
+// The discovered issuer becomes the expected iss when Issuers is empty.
+func (t *Authenticator) resolveEndpoints(ctx context.Context, client *http.Client) error {
+	meta := &providerMetadata{}
+	if t.TokenEndpoint == "" || t.JWKSURI == "" {
+		discovered, err := discover(ctx, client, t.Host)
+		switch {
+		case err == nil:
+			meta = discovered
+		case !errors.Is(err, errDiscoveryUnavailable):
+			return fmt.Errorf("openid discovery: %w", err)
+		}
+	}
+
+	fallback := func(path string) string {
+		if t.Host == "" {
+			return ""
+		}
+		return strings.TrimSuffix(t.Host, "/") + path
+	}
+
+	t.TokenEndpoint = cmp.Or(t.TokenEndpoint, meta.TokenEndpoint, fallback("/token"))
+	t.JWKSURI = cmp.Or(t.JWKSURI, meta.JWKSURI, fallback("/.well-known/jwks.json"))
+	t.IntrospectionEndpoint = cmp.Or(t.IntrospectionEndpoint, meta.IntrospectionEndpoint, fallback("/introspect"))
+	t.RevocationEndpoint = cmp.Or(t.RevocationEndpoint, meta.RevocationEndpoint, fallback("/revoke"))
+	t.DeviceAuthorizationEndpoint = cmp.Or(t.DeviceAuthorizationEndpoint, meta.DeviceAuthorizationEndpoint, fallback("/device"))
+
+	if len(t.Issuers) == 0 && meta.Issuer != "" {
+		t.Issuers = []string{meta.Issuer}
+	}
+
+	return nil
+}
@@ -0,0 +1,402 @@
+package service
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	dpopProofType = "dpop+jwt"
+	dpopScheme    = "DPoP"
+
+	// defaultDPoPMaxAge bounds how far a proof's iat may be from now.
+	defaultDPoPMaxAge = time.Minute
+	// defaultReplayCacheSize bounds the in-memory cache of used proof ids.
+	defaultReplayCacheSize = 1 << 16
+)
+
+var (
+	ErrDPoPProofInvalid  = errors.New("DPoP proof is invalid")
+	ErrDPoPProofReplayed = errors.New("DPoP proof was already used")
+	ErrDPoPKeyMismatch   = errors.New("token is not bound to the DPoP proof key")
+)
+
+// defaultDPoPAlgorithms are the proof algorithms AuthenticateDPoP accepts unless
+// configured otherwise. Proofs must be signed with an asymmetric key.
+var defaultDPoPAlgorithms = []jose.SignatureAlgorithm{
+	jose.ES256, jose.ES384, jose.ES512, jose.EdDSA,
+	jose.RS256, jose.RS384, jose.RS512, jose.PS256, jose.PS384, jose.PS512,
+}
+
+// dpopKey is the key pair an Authenticator proves possession of (RFC 9449). It is
+// generated for each Authenticator and never leaves the process.
+type dpopKey struct {
+	signer jose.Signer
+	// jkt is the key's RFC 7638 thumbprint, the cnf.jkt of tokens bound to it.
+	jkt string
+
+	mu sync.Mutex
+	// nonces holds the last DPoP-Nonce sent by each server, by origin.
+	nonces map[string]string
+}
+
+func newDPoPKey() (*dpopKey, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate DPoP key: %w", err)
+	}
+
+	thumbprint, err := (&jose.JSONWebKey{Key: key.Public()}).Thumbprint(crypto.SHA256)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compute DPoP key thumbprint: %w", err)
+	}
+
+	signer, err := jose.NewSigner(
+		jose.SigningKey{Algorithm: jose.ES256, Key: key},
+		(&jose.SignerOptions{EmbedJWK: true}).WithType(dpopProofType),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create DPoP signer: %w", err)
+	}
+
+	return &dpopKey{
+		signer: signer,
+		jkt:    base64.RawURLEncoding.EncodeToString(thumbprint),
+		nonces: map[string]string{},
+	}, nil
+}
+
+// proof returns a DPoP proof for a method request to uri. With accessToken it is
+// bound to that token through ath. The last nonce received from uri's origin is
+// included.
+func (k *dpopKey) proof(method, uri, accessToken string) (string, error) {
+	htu, origin, err := dpopTarget(uri)
+	if err != nil {
+		return "", err
+	}
+
+	claims := map[string]any{
+		"jti": UUID(),
+		"htm": method,
+		"htu": htu,
+		"iat": time.Now().Unix(),
+	}
+	if accessToken != "" {
+		claims["ath"] = accessTokenHash(accessToken)
+	}
+
+	k.mu.Lock()
+	if nonce := k.nonces[origin]; nonce != "" {
+		claims["nonce"] = nonce
+	}
+	k.mu.Unlock()
+
+	return jwt.Signed(k.signer).Claims(claims).Serialize()
+}
+
+// track remembers the DPoP-Nonce resp carries, if any, for uri's origin.
+func (k *dpopKey) track(uri string, resp *http.Response) {
+	nonce := resp.Header.Get("DPoP-Nonce")
+	if nonce == "" {
+		return
+	}
+
+	_, origin, err := dpopTarget(uri)
+	if err != nil {
+		return
+	}
+
+	k.mu.Lock()
+	k.nonces[origin] = nonce
+	k.mu.Unlock()
+}
+
+// DPoPProof returns a DPoP proof for a method request to uri carrying
+// accessToken, for sending a token obtained with DPoP enabled over a client other
+// than Transport. The token goes in an "Authorization: DPoP" header and the proof
+// in a DPoP header. It fails when DPoP is not enabled.
+func (t *Authenticator) DPoPProof(method, uri, accessToken string) (string, error) {
+	if t.dpop == nil {
+		return "", errors.New("DPoP is not enabled")
+	}
+	return t.dpop.proof(method, uri, accessToken)
+}
+
+// dpopTarget returns uri without query and fragment, as sent in htu, and its
+// origin.
+func dpopTarget(uri string) (htu, origin string, err error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to parse DPoP target: %w", err)
+	}
+
+	u.RawQuery, u.ForceQuery, u.Fragment, u.RawFragment = "", false, "", ""
+
+	return u.String(), u.Scheme + "://" + u.Host, nil
+}
+
+// normalizeTarget returns uri in a form that compares equal for equivalent URIs:
+// scheme and host in lower case, without default port, query and fragment.
+func normalizeTarget(uri string) string {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return ""
+	}
+
+	u.Scheme = strings.ToLower(u.Scheme)
+	u.Host = strings.ToLower(u.Host)
+	if port := u.Port(); (u.Scheme == "https" && port == "443") || (u.Scheme == "http" && port == "80") {
+		u.Host = u.Hostname()
+	}
+	if u.Path == "" {
+		u.Path = "/"
+	}
+	u.RawQuery, u.ForceQuery, u.Fragment, u.RawFragment = "", false, "", ""
+
+	return u.String()
+}
+
+// accessTokenHash is the ath of a proof carrying token.
+func accessTokenHash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// dpopNonceRequired reports whether resp asks for a DPoP proof with the nonce it
+// carries (RFC 9449, sections 8 and 9).
+func dpopNonceRequired(resp *http.Response) bool {
+	return resp.Header.Get("DPoP-Nonce") != "" && strings.Contains(resp.Header.Get("WWW-Authenticate"), "use_dpop_nonce")
+}
+
+// ReplayCache remembers the DPoP proofs AuthenticateDPoP accepted, so that a
+// captured proof cannot be sent again.
+type ReplayCache interface {
+	// Seen records key for ttl and reports whether it was already recorded.
+	Seen(ctx context.Context, key string, ttl time.Duration) (bool, error)
+}
+
+// MemoryReplayCache is a ReplayCache in process memory, for a single replica.
+type MemoryReplayCache struct {
+	cache *ttlCache[struct{}]
+}
+
+// NewMemoryReplayCache returns a ReplayCache holding up to size proofs; 65536
+// when size is not positive. When full, the oldest proofs are forgotten early, so
+// size should cover the proofs received within DPoPOptions.MaxAge.
+func NewMemoryReplayCache(size int) *MemoryReplayCache {
+	if size <= 0 {
+		size = defaultReplayCacheSize
+	}
+	return &MemoryReplayCache{cache: newTTLCache[struct{}](size)}
+}
+
+// Seen implements ReplayCache.
+func (c *MemoryReplayCache) Seen(_ context.Context, key string, ttl time.Duration) (bool, error) {
+	now := time.Now()
+	return !c.cache.add(key, struct{}{}, now, now.Add(ttl)), nil
+}
+
+// RedisReplayCache is a ReplayCache on top of the redis Ring returned by
+// NewRedis, shared by every replica of a service.
+type RedisReplayCache struct {
+	ring   *redis.Ring
+	prefix string
+}
+
+// NewRedisReplayCache returns a ReplayCache keeping its entries under prefix in
+// ring.
+func NewRedisReplayCache(ring *redis.Ring, prefix string) *RedisReplayCache {
+	return &RedisReplayCache{ring: ring, prefix: prefix}
+}
+
+// Seen implements ReplayCache.
+func (c *RedisReplayCache) Seen(ctx context.Context, key string, ttl time.Duration) (bool, error) {
+	ok, err := c.ring.SetNX(ctx, c.prefix+key, 1, ttl).Result()
+	if err != nil {
+		return false, err
+	}
+	return !ok, nil
+}
+
+// DPoPOptions configures AuthenticateDPoP.
+type DPoPOptions struct {
+	// ReplayCache remembers accepted proofs; a MemoryReplayCache by default. Use a
+	// RedisReplayCache when the service runs more than one replica.
+	ReplayCache ReplayCache
+	// MaxAge is how far a proof's iat may be from now, in either direction; one
+	// minute by default.
+	MaxAge time.Duration
+	// Algorithms lists the accepted proof algorithms; the asymmetric JWS
+	// algorithms by default.
+	Algorithms []jose.SignatureAlgorithm
+	// URL returns the URL a request was sent to, checked against the proof's htu.
+	// By default it is built from the request's Host and path, with https when it
+	// arrived over TLS. Behind a proxy terminating TLS, return the external URL.
+	URL func(r *http.Request) string
+	// AllowBearer also accepts Bearer tokens that are not bound to a key, e.g.
+	// while clients migrate. Bound tokens always need a proof.
+	AllowBearer bool
+}
+
+// AuthenticateDPoP returns middleware that requires an "Authorization: DPoP"
+// token accepted by v, along with a DPoP proof (RFC 9449, section 7) of the key
+// the token is bound to. The proof must be signed by the key in the token's
+// cnf.jkt claim, match the request's method and URL, carry the token's hash and a
+// recent iat, and not have been used before. Failures get 401 with a DPoP
+// WWW-Authenticate challenge. Like Authenticate, the claims and token are then
+// available through ClaimsFromContext and TokenFromContext. Server nonces are not
+// issued.
+func AuthenticateDPoP(v TokenVerifier, opts DPoPOptions) func(http.Handler) http.Handler {
+	if opts.ReplayCache == nil {
+		opts.ReplayCache = NewMemoryReplayCache(0)
+	}
+	if opts.MaxAge <= 0 {
+		opts.MaxAge = defaultDPoPMaxAge
+	}
+	if len(opts.Algorithms) == 0 {
+		opts.Algorithms = defaultDPoPAlgorithms
+	}
+	if opts.URL == nil {
+		opts.URL = requestURL
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			header := r.Header.Get("Authorization")
+			if header == "" {
+				writeChallenge(w, dpopScheme, http.StatusUnauthorized, "", "")
+				return
+			}
+
+			scheme, token, _ := strings.Cut(header, " ")
+			token = strings.TrimSpace(token)
+			bearer := strings.EqualFold(scheme, "Bearer") && opts.AllowBearer
+			if (!strings.EqualFold(scheme, dpopScheme) && !bearer) || token == "" {
+				writeChallenge(w, dpopScheme, http.StatusBadRequest, "invalid_request", "authorization header must carry a DPoP token")
+				return
+			}
+
+			claims, err := v.VerifyClaims(r.Context(), token, nil)
+			if err != nil {
+				writeChallenge(w, dpopScheme, http.StatusUnauthorized, "invalid_token", verifyErrorDescription(err))
+				return
+			}
+
+			jkt, _ := claimAt(claims.Raw, "cnf.jkt").(string)
+			switch {
+			case bearer && jkt != "":
+				writeChallenge(w, dpopScheme, http.StatusUnauthorized, "invalid_token", "token is bound to a DPoP key")
+				return
+			case !bearer:
+				if err := verifyDPoPProof(r, token, jkt, opts); err != nil {
+					writeChallenge(w, dpopScheme, http.StatusUnauthorized, "invalid_dpop_proof", err.Error())
+					return
+				}
+			}
+
+			ctx := context.WithValue(ContextWithClaims(r.Context(), claims), tokenContextKey{}, token)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// dpopClaims are the claims of a DPoP proof.
+type dpopClaims struct {
+	ID       string           `json:"jti"`
+	Method   string           `json:"htm"`
+	URI      string           `json:"htu"`
+	IssuedAt *jwt.NumericDate `json:"iat"`
+	ATH      string           `json:"ath"`
+}
+
+// verifyDPoPProof checks the DPoP proof sent with r for token, bound to the key
+// with thumbprint jkt. Its errors are safe to send back to the client.
+func verifyDPoPProof(r *http.Request, token, jkt string, opts DPoPOptions) error {
+	values := r.Header.Values("DPoP")
+	if len(values) != 1 {
+		return fmt.Errorf("%w: exactly one DPoP header is required", ErrDPoPProofInvalid)
+	}
+
+	jws, err := jose.ParseSigned(values[0], opts.Algorithms)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrDPoPProofInvalid, err)
+	}
+
+	header := jws.Signatures[0].Header
+	if typ, _ := header.ExtraHeaders[jose.HeaderType].(string); typ != dpopProofType {
+		return fmt.Errorf("%w: typ must be %s", ErrDPoPProofInvalid, dpopProofType)
+	}
+	if header.JSONWebKey == nil || !header.JSONWebKey.IsPublic() {
+		return fmt.Errorf("%w: jwk must be a public key", ErrDPoPProofInvalid)
+	}
+
+	payload, err := jws.Verify(header.JSONWebKey)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrDPoPProofInvalid, err)
+	}
+
+	var claims dpopClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return fmt.Errorf("%w: %w", ErrDPoPProofInvalid, err)
+	}
+
+	switch {
+	case claims.ID == "":
+		return fmt.Errorf("%w: jti is missing", ErrDPoPProofInvalid)
+	case claims.Method != r.Method:
+		return fmt.Errorf("%w: htm does not match the request method", ErrDPoPProofInvalid)
+	case normalizeTarget(claims.URI) == "" || normalizeTarget(claims.URI) != normalizeTarget(opts.URL(r)):
+		return fmt.Errorf("%w: htu does not match the request URL", ErrDPoPProofInvalid)
+	case claims.IssuedAt == nil || time.Since(claims.IssuedAt.Time()).Abs() > opts.MaxAge:
+		return fmt.Errorf("%w: iat is missing or too far from now", ErrDPoPProofInvalid)
+	case claims.ATH != accessTokenHash(token):
+		return fmt.Errorf("%w: ath does not match the access token", ErrDPoPProofInvalid)
+	}
+
+	thumbprint, err := header.JSONWebKey.Thumbprint(crypto.SHA256)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrDPoPProofInvalid, err)
+	}
+	if jkt == "" || base64.RawURLEncoding.EncodeToString(thumbprint) != jkt {
+		return ErrDPoPKeyMismatch
+	}
+
+	// A proof stays acceptable for MaxAge after and before its iat.
+	seen, err := opts.ReplayCache.Seen(r.Context(), "dpop:"+jkt+":"+claims.ID, 2*opts.MaxAge)
+	if err != nil {
+		log.Printf("[ERROR] failed to check DPoP proof replay: %v", err)
+		return fmt.Errorf("%w: it could not be checked", ErrDPoPProofInvalid)
+	}
+	if seen {
+		return ErrDPoPProofReplayed
+	}
+
+	return nil
+}
+
+// requestURL returns the URL r was sent to, as seen by this server.
+func requestURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host + r.URL.Path
+}
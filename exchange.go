@@ -0,0 +1,62 @@
+package service
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	grantTypeTokenExchange = "urn:ietf:params:oauth:grant-type:token-exchange"
+	tokenTypeAccessToken   = "urn:ietf:params:oauth:token-type:access_token"
+
+	defaultExchangeCacheSize = 1024
+)
+
+// Exchange trades subjectToken, typically the access token of the user calling
+// this service, for a token for audience limited to scopes, using the OAuth 2.0
+// Token Exchange grant (RFC 8693) on the token endpoint. The client authenticates
+// as for its own tokens.
+//
+// Exchanged tokens are cached per subject token, audience and scope set until
+// shortly before they expire. The cache is keyed by a hash of the subject token,
+// never by the token itself.
+func (t *Authenticator) Exchange(ctx context.Context, subjectToken, audience string, scopes []string) (string, error) {
+	if subjectToken == "" {
+		return "", errors.New("subject token is empty")
+	}
+
+	scopes = slices.Sorted(slices.Values(scopes))
+	key := tokenHash(subjectToken) + "\x00" + audience + "\x00" + strings.Join(scopes, " ")
+
+	if token, ok := t.exchanged.get(key, time.Now()); ok {
+		return token, nil
+	}
+
+	data := scopeParams(audience, scopes)
+	data.Set("grant_type", grantTypeTokenExchange)
+	data.Set("subject_token", subjectToken)
+	data.Set("subject_token_type", tokenTypeAccessToken)
+	data.Set("requested_token_type", tokenTypeAccessToken)
+
+	tk, err := t.tokenRequest(ctx, data)
+	if err != nil {
+		return "", err
+	}
+
+	if !tk.expiresAt.IsZero() {
+		t.exchanged.set(key, tk.AccessToken, tk.expiresAt.Add(-tokenExpiryLeeway))
+	}
+
+	return tk.AccessToken, nil
+}
+
+// tokenHash returns a hex encoded SHA-256 of token, used wherever tokens key a cache.
+func tokenHash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
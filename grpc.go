@@ -0,0 +1,175 @@
+package service
+
+import (
+	"context"
+	"log"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// errRPCDPoP is returned by the client interceptors for tokens bound to a DPoP
+// key. DPoP proofs are made for HTTP requests, and sending such a token as a
+// Bearer token would only get it rejected.
+var errRPCDPoP = status.Error(codes.Unauthenticated, "DPoP-bound tokens cannot be sent over gRPC")
+
+// rpcCredentials sends one token as per-RPC credentials.
+type rpcCredentials struct {
+	tk       *jwtToken
+	insecure bool
+}
+
+func (c rpcCredentials) GetRequestMetadata(context.Context, ...string) (map[string]string, error) {
+	if c.tk == nil {
+		return nil, nil
+	}
+	return map[string]string{"authorization": "Bearer " + c.tk.AccessToken}, nil
+}
+
+// RequireTransportSecurity keeps tokens off plaintext connections unless
+// InsecureRPC is configured, e.g. inside a mesh that encrypts traffic itself.
+func (c rpcCredentials) RequireTransportSecurity() bool {
+	return !c.insecure
+}
+
+// UnaryClientInterceptor returns a gRPC client interceptor that sends the access
+// token as per-RPC credentials, over TLS connections only unless InsecureRPC is
+// configured. When a call fails with Unauthenticated it refreshes the token once
+// and retries the call, like Transport does for 401s.
+// DPoP is HTTP-only: with DPoP configured, calls fail with Unauthenticated
+// without sending the bound token.
+func (t *Authenticator) UnaryClientInterceptor() grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		if t.dpop != nil {
+			return errRPCDPoP
+		}
+		tk := t.current(ctx)
+
+		err := invoker(ctx, method, req, reply, cc, append(opts, grpc.PerRPCCredentials(rpcCredentials{tk, t.insecureRPC}))...)
+		if status.Code(err) != codes.Unauthenticated {
+			return err
+		}
+
+		if rerr := t.refresh(ctx, tk); rerr != nil {
+			log.Printf("[ERROR] failed to refresh token after Unauthenticated: %v", rerr)
+			return err
+		}
+
+		return invoker(ctx, method, req, reply, cc, append(opts, grpc.PerRPCCredentials(rpcCredentials{t.tk.Load(), t.insecureRPC}))...)
+	}
+}
+
+// StreamClientInterceptor returns a gRPC client interceptor that sends the access
+// token as per-RPC credentials on streams. A stream failing to open with
+// Unauthenticated is retried once after a refresh. Once messages have been
+// exchanged a stream cannot be replayed, so an Unauthenticated error received on
+// it is returned, but the token is refreshed for the streams that follow. Like
+// UnaryClientInterceptor it refuses to send DPoP-bound tokens.
+func (t *Authenticator) StreamClientInterceptor() grpc.StreamClientInterceptor {
+	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		if t.dpop != nil {
+			return nil, errRPCDPoP
+		}
+		tk := t.current(ctx)
+
+		stream, err := streamer(ctx, desc, cc, method, append(opts, grpc.PerRPCCredentials(rpcCredentials{tk, t.insecureRPC}))...)
+		if status.Code(err) == codes.Unauthenticated {
+			if rerr := t.refresh(ctx, tk); rerr != nil {
+				log.Printf("[ERROR] failed to refresh token after Unauthenticated: %v", rerr)
+				return nil, err
+			}
+			tk = t.tk.Load()
+			stream, err = streamer(ctx, desc, cc, method, append(opts, grpc.PerRPCCredentials(rpcCredentials{tk, t.insecureRPC}))...)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		return &clientStream{ClientStream: stream, ctx: ctx, auth: t, tk: tk}, nil
+	}
+}
+
+// clientStream refreshes the token sent on it when the server rejects it.
+type clientStream struct {
+	grpc.ClientStream
+	ctx  context.Context
+	auth *Authenticator
+	tk   *jwtToken
+}
+
+func (s *clientStream) RecvMsg(m any) error {
+	err := s.ClientStream.RecvMsg(m)
+	if status.Code(err) == codes.Unauthenticated {
+		// The stream's own context is done by now; the refresh is for the next one.
+		if rerr := s.auth.refresh(context.WithoutCancel(s.ctx), s.tk); rerr != nil {
+			log.Printf("[ERROR] failed to refresh token after Unauthenticated: %v", rerr)
+		}
+	}
+	return err
+}
+
+// UnaryServerInterceptor returns a gRPC server interceptor that requires a bearer
+// token accepted by v in the authorization metadata. Calls without one, or with a
+// rejected one, fail with Unauthenticated, as do tokens bound to a DPoP key, whose
+// proof cannot be checked over gRPC. The verified claims are available to
+// handlers through ClaimsFromContext and the token through TokenFromContext.
+func UnaryServerInterceptor(v TokenVerifier) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		ctx, err := authenticateRPC(ctx, v)
+		if err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+// StreamServerInterceptor is the streaming counterpart of UnaryServerInterceptor.
+func StreamServerInterceptor(v TokenVerifier) grpc.StreamServerInterceptor {
+	return func(srv any, ss grpc.ServerStream, _ *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx, err := authenticateRPC(ss.Context(), v)
+		if err != nil {
+			return err
+		}
+		return handler(srv, &serverStream{ServerStream: ss, ctx: ctx})
+	}
+}
+
+// serverStream carries the context with the verified claims.
+type serverStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *serverStream) Context() context.Context {
+	return s.ctx
+}
+
+// authenticateRPC verifies the bearer token in ctx's incoming metadata and returns
+// ctx carrying its claims.
+func authenticateRPC(ctx context.Context, v TokenVerifier) (context.Context, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+
+	values := md.Get("authorization")
+	if len(values) == 0 {
+		return nil, status.Error(codes.Unauthenticated, "bearer token is missing")
+	}
+
+	scheme, token, ok := strings.Cut(values[0], " ")
+	token = strings.TrimSpace(token)
+	if !ok || !strings.EqualFold(scheme, "Bearer") || token == "" {
+		return nil, status.Error(codes.Unauthenticated, "authorization metadata must carry a Bearer token")
+	}
+
+	claims, err := v.VerifyClaims(ctx, token, nil)
+	if err != nil {
+		return nil, status.Error(codes.Unauthenticated, verifyErrorDescription(err))
+	}
+	if _, bound := claimAt(claims.Raw, "cnf.jkt").(string); bound {
+		return nil, status.Error(codes.Unauthenticated, "token is bound to a DPoP key")
+	}
+
+	return context.WithValue(ContextWithClaims(ctx, claims), tokenContextKey{}, token), nil
+}
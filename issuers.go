@@ -0,0 +1,207 @@
+package service
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+)
+
+// ErrNoIssuers is returned by NewMultiVerifier when no issuer is configured.
+var ErrNoIssuers = errors.New("no issuers configured")
+
+// IssuerConfig configures one identity provider accepted by a MultiVerifier.
+type IssuerConfig struct {
+	// Issuer is the exact iss value of the provider's tokens.
+	Issuer string
+	// JWKSURI is the provider's key set, discovered from Issuer's
+	// /.well-known/openid-configuration when empty, falling back to
+	// Issuer/.well-known/jwks.json. KeyID pins verification to the JWK with this
+	// kid.
+	JWKSURI string
+	KeyID   string
+
+	// Algorithms lists the JWS algorithms accepted from this issuer; RS256 by
+	// default.
+	Algorithms []jose.SignatureAlgorithm
+	// Audiences, when not empty, lists the accepted aud values. Leeway is the
+	// tolerated clock skew, DefaultLeeway by default.
+	Audiences []string
+	Leeway    time.Duration
+}
+
+// MultiVerifierConfig configures a MultiVerifier created with NewMultiVerifier.
+type MultiVerifierConfig struct {
+	Issuers []IssuerConfig
+
+	// HTTPClient's Transport is used for discovery and JWKS requests, which are
+	// bounded by JWKSTimeout, three seconds by default.
+	HTTPClient  *http.Client
+	JWKSTimeout time.Duration
+
+	// Observer receives the JWKS and verification events of every issuer.
+	Observer Observer
+}
+
+// MultiVerifier verifies tokens from several issuers, each with its own key set,
+// algorithms and audiences. The issuer is picked by the token's iss claim before
+// the signature is checked, so a token is only ever verified with the keys of the
+// issuer it claims. Like Authenticator it implements TokenVerifier, so it works
+// with Authenticate and the gRPC server interceptors, and returns the same
+// Claims and errors.
+type MultiVerifier struct {
+	issuers    map[string]*issuer
+	algorithms []jose.SignatureAlgorithm
+	observer   Observer
+	client     *http.Client
+
+	cancel    context.CancelFunc
+	wg        sync.WaitGroup
+	closeOnce sync.Once
+}
+
+// issuer is one identity provider of a MultiVerifier.
+type issuer struct {
+	IssuerConfig
+	jwks *keySet
+}
+
+// NewMultiVerifier resolves the JWKS of every issuer and loads them. The key sets
+// are then kept fresh in the background until ctx is cancelled or Close is called.
+func NewMultiVerifier(ctx context.Context, cfg MultiVerifierConfig) (*MultiVerifier, error) {
+	if len(cfg.Issuers) == 0 {
+		return nil, ErrNoIssuers
+	}
+
+	v := &MultiVerifier{
+		issuers:  map[string]*issuer{},
+		observer: cfg.Observer,
+	}
+	if v.observer == nil {
+		v.observer = NopObserver{}
+	}
+
+	var transport http.RoundTripper
+	if cfg.HTTPClient != nil {
+		transport = cfg.HTTPClient.Transport
+	}
+	v.client = &http.Client{Transport: transport, Timeout: cmp.Or(cfg.JWKSTimeout, defaultJWKSTimeout)}
+
+	intervals := map[string]time.Duration{}
+	for _, ic := range cfg.Issuers {
+		if ic.Issuer == "" {
+			return nil, errors.New("issuer must not be empty")
+		}
+		if _, ok := v.issuers[ic.Issuer]; ok {
+			return nil, fmt.Errorf("duplicate issuer %q", ic.Issuer)
+		}
+
+		ic.Leeway = cmp.Or(ic.Leeway, DefaultLeeway)
+		if len(ic.Algorithms) == 0 {
+			ic.Algorithms = []jose.SignatureAlgorithm{jose.RS256}
+		}
+		for _, alg := range ic.Algorithms {
+			if !slices.Contains(v.algorithms, alg) {
+				v.algorithms = append(v.algorithms, alg)
+			}
+		}
+
+		if ic.JWKSURI == "" {
+			meta, err := discover(ctx, v.client, ic.Issuer)
+			switch {
+			case err == nil && meta.JWKSURI != "":
+				ic.JWKSURI = meta.JWKSURI
+			case err == nil || errors.Is(err, errDiscoveryUnavailable):
+				ic.JWKSURI = strings.TrimSuffix(ic.Issuer, "/") + "/.well-known/jwks.json"
+			default:
+				return nil, fmt.Errorf("openid discovery for %q: %w", ic.Issuer, err)
+			}
+		}
+
+		iss := &issuer{
+			IssuerConfig: ic,
+			jwks:         &keySet{uri: ic.JWKSURI, keyID: ic.KeyID, client: v.client, observer: v.observer},
+		}
+
+		interval, err := iss.jwks.load(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load JWKS for %q: %w", ic.Issuer, err)
+		}
+
+		v.issuers[ic.Issuer] = iss
+		intervals[ic.Issuer] = interval
+	}
+
+	ctx, v.cancel = context.WithCancel(ctx)
+	for name, iss := range v.issuers {
+		v.wg.Go(func() {
+			iss.jwks.run(ctx, intervals[name])
+		})
+	}
+
+	return v, nil
+}
+
+// VerifyClaims picks the issuer by the token's iss claim, checks the signature
+// with that issuer's keys and algorithms and validates the registered claims
+// like Authenticator.VerifyClaims, against that issuer's audiences. Tokens from
+// issuers that are not configured fail with ErrTokenWrongIssuer. When custom is
+// not nil the payload is also decoded into it.
+func (v *MultiVerifier) VerifyClaims(ctx context.Context, token string, custom any) (*Claims, error) {
+	claims, err := v.verifyClaims(ctx, token, custom)
+	if err != nil {
+		v.observer.OnVerifyFailure(VerifyFailureEvent{Reason: verifyFailureReason(err), Err: err})
+	}
+	return claims, err
+}
+
+func (v *MultiVerifier) verifyClaims(ctx context.Context, token string, custom any) (*Claims, error) {
+	jws, err := jose.ParseSigned(token, v.algorithms)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrTokenMalformed, err)
+	}
+
+	// The payload is not trusted yet; iss only selects the keys to check it with.
+	var unverified struct {
+		Issuer string `json:"iss"`
+	}
+	if err := json.Unmarshal(jws.UnsafePayloadWithoutVerification(), &unverified); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrTokenInvalidPayload, err)
+	}
+
+	iss, ok := v.issuers[unverified.Issuer]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrTokenWrongIssuer, unverified.Issuer)
+	}
+
+	alg := jose.SignatureAlgorithm(jws.Signatures[0].Header.Algorithm)
+	if !slices.Contains(iss.Algorithms, alg) {
+		return nil, fmt.Errorf("%w: algorithm %s is not accepted for issuer %q", ErrKeyAlgorithmMismatch, alg, iss.Issuer)
+	}
+
+	payload, err := iss.jwks.verify(ctx, jws)
+	if err != nil {
+		return nil, err
+	}
+
+	return decodeClaims(payload, custom, iss.Leeway, []string{iss.Issuer}, iss.Audiences)
+}
+
+// Close stops the background JWKS reloads and waits for them to exit. Calling
+// Close again is a no-op.
+func (v *MultiVerifier) Close() error {
+	v.closeOnce.Do(func() {
+		v.cancel()
+		v.wg.Wait()
+		v.client.CloseIdleConnections()
+	})
+	return nil
+}
@@ -0,0 +1,296 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+)
+
+const (
+	// jwksDefaultRefreshInterval is used when the JWKS response carries no max-age.
+	jwksDefaultRefreshInterval = time.Hour
+	// jwksMinRefreshInterval bounds both the scheduled reload and the retry after a
+	// failed one, so a zero max-age or a flapping server cannot cause a hot loop.
+	jwksMinRefreshInterval = time.Minute
+	// jwksMaxRefreshInterval caps very long max-age values.
+	jwksMaxRefreshInterval = 24 * time.Hour
+	// jwksRefetchInterval rate-limits on-demand reloads triggered by unknown kids.
+	jwksRefetchInterval = 30 * time.Second
+)
+
+// keySet holds the auth service's public keys. The set is replaced as a whole
+// through an atomic pointer, the same way Authenticator swaps tokens, so readers
+// never observe a partially loaded set.
+type keySet struct {
+	uri      string
+	keyID    string
+	client   *http.Client
+	observer Observer
+	// onChange, when set, is called after a reload changed the keys.
+	onChange func()
+
+	keys atomic.Pointer[jose.JSONWebKeySet]
+	// version is incremented whenever a reload changes the keys.
+	version atomic.Uint64
+
+	mu        sync.Mutex
+	fetchedAt time.Time
+}
+
+// current returns the key set loaded most recently.
+func (k *keySet) current() *jose.JSONWebKeySet {
+	return k.keys.Load()
+}
+
+// lookup returns the keys matching kid. When none match it reloads the set,
+// unless a reload happened within jwksRefetchInterval, and looks again.
+func (k *keySet) lookup(ctx context.Context, kid string) []jose.JSONWebKey {
+	if keys := k.current().Key(kid); len(keys) > 0 {
+		return keys
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	// Another caller may have reloaded the set while this one waited for mu.
+	if keys := k.current().Key(kid); len(keys) > 0 {
+		return keys
+	}
+	if time.Since(k.fetchedAt) < jwksRefetchInterval {
+		return nil
+	}
+
+	if _, err := k.fetch(ctx); err != nil {
+		log.Printf("[ERROR] failed to refetch JWKS for kid %q: %v", kid, err)
+		return nil
+	}
+
+	return k.current().Key(kid)
+}
+
+// load fetches the key set and returns how long it may be cached.
+func (k *keySet) load(ctx context.Context) (time.Duration, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	return k.fetch(ctx)
+}
+
+// fetch must be called with mu held.
+func (k *keySet) fetch(ctx context.Context) (time.Duration, error) {
+	k.fetchedAt = time.Now()
+
+	jwks, maxAge, err := getJWKS(ctx, k.client, k.uri, k.keyID)
+	event := JWKSReloadEvent{Duration: time.Since(k.fetchedAt), Err: err}
+	if jwks != nil {
+		event.Keys = len(jwks.Keys)
+	}
+	k.observer.OnJWKSReload(event)
+	if err != nil {
+		return 0, err
+	}
+
+	if old := k.keys.Swap(jwks); old != nil && !sameKeys(old, jwks) {
+		k.version.Add(1)
+		if k.onChange != nil {
+			k.onChange()
+		}
+	}
+
+	return maxAge, nil
+}
+
+// verify checks the signature of jws against the set and returns its payload. The
+// key is picked by kid, reloading the set when the kid is unknown, and must match
+// the token's algorithm.
+func (k *keySet) verify(ctx context.Context, jws *jose.JSONWebSignature) ([]byte, error) {
+	header := jws.Signatures[0].Header
+
+	keys := k.current().Keys
+	if header.KeyID != "" {
+		keys = k.lookup(ctx, header.KeyID)
+		if len(keys) == 0 {
+			return nil, fmt.Errorf("verify token: %w: %q", ErrUnknownKeyID, header.KeyID)
+		}
+	}
+
+	alg := jose.SignatureAlgorithm(header.Algorithm)
+	keys = slices.DeleteFunc(slices.Clone(keys), func(key jose.JSONWebKey) bool {
+		return !keyMatchesAlgorithm(key, alg)
+	})
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("verify token: %w: %s", ErrKeyAlgorithmMismatch, alg)
+	}
+
+	var err error
+	for _, key := range keys {
+		payload, verr := jws.Verify(key.Key)
+		if verr == nil {
+			return payload, nil
+		}
+		err = verr
+	}
+
+	return nil, fmt.Errorf("verify token: %w", err)
+}
+
+// sameKeys reports whether a and b hold the same keys in the same order.
+func sameKeys(a, b *jose.JSONWebKeySet) bool {
+	ja, err := json.Marshal(a)
+	if err != nil {
+		return false
+	}
+	jb, err := json.Marshal(b)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(ja, jb)
+}
+
+// run reloads the key set whenever the cached copy goes stale, until ctx is done.
+func (k *keySet) run(ctx context.Context, interval time.Duration) {
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-timer.C:
+			next, err := k.load(ctx)
+			if err != nil {
+				log.Printf("[ERROR] failed to reload JWKS: %v", err)
+				next = jwksMinRefreshInterval
+			}
+			timer.Reset(next)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// getJWKS fetches the auth service's key set and keeps the public RSA, EC and OKP
+// (Ed25519) signing keys.
+// When keyID is set only that key is kept, pinning verification to a single key.
+// The returned duration is the Cache-Control max-age, clamped to sane bounds.
+func getJWKS(ctx context.Context, client *http.Client, uri, keyID string) (*jose.JSONWebKeySet, time.Duration, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, uri, nil)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("wrong status code: %d (%s)", resp.StatusCode, http.StatusText(resp.StatusCode))
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var jwks = jose.JSONWebKeySet{}
+	if err := json.Unmarshal(body, &jwks); err != nil {
+		return nil, 0, err
+	}
+
+	if len(jwks.Keys) == 0 {
+		return nil, 0, errors.New("public JWKS not found")
+	}
+
+	keys := make([]jose.JSONWebKey, 0, len(jwks.Keys))
+	for _, key := range jwks.Keys {
+		if keyID != "" && key.KeyID != keyID {
+			continue
+		}
+		if key.Use == "enc" || !key.IsPublic() {
+			continue
+		}
+		switch key.Key.(type) {
+		case *rsa.PublicKey, *ecdsa.PublicKey, ed25519.PublicKey:
+			keys = append(keys, key)
+		}
+	}
+
+	if len(keys) == 0 {
+		if keyID != "" {
+			return nil, 0, errors.New("public JWK not found")
+		}
+		return nil, 0, errors.New("JWKS has no public signing keys")
+	}
+
+	return &jose.JSONWebKeySet{Keys: keys}, cacheMaxAge(resp.Header.Get("Cache-Control")), nil
+}
+
+// keyMatchesAlgorithm reports whether key may verify signatures made with alg.
+// The key type, and for EC keys the curve, must be the one the algorithm is
+// defined for, and a key that declares its own alg is only used for that alg, so a
+// token cannot steer verification to an algorithm the key was never meant for.
+func keyMatchesAlgorithm(key jose.JSONWebKey, alg jose.SignatureAlgorithm) bool {
+	if key.Algorithm != "" && key.Algorithm != string(alg) {
+		return false
+	}
+
+	switch k := key.Key.(type) {
+	case *rsa.PublicKey:
+		switch alg {
+		case jose.RS256, jose.RS384, jose.RS512, jose.PS256, jose.PS384, jose.PS512:
+			return true
+		}
+	case *ecdsa.PublicKey:
+		switch alg {
+		case jose.ES256:
+			return k.Curve == elliptic.P256()
+		case jose.ES384:
+			return k.Curve == elliptic.P384()
+		case jose.ES512:
+			return k.Curve == elliptic.P521()
+		}
+	case ed25519.PublicKey:
+		return alg == jose.EdDSA
+	}
+
+	return false
+}
+
+// cacheMaxAge extracts max-age from a Cache-Control header value. Missing or
+// invalid values fall back to jwksDefaultRefreshInterval.
+func cacheMaxAge(header string) time.Duration {
+	for _, directive := range strings.Split(header, ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(directive), "=")
+		if !strings.EqualFold(name, "max-age") {
+			continue
+		}
+
+		seconds, err := strconv.Atoi(strings.Trim(value, `"`))
+		if err != nil || seconds < 0 {
+			break
+		}
+
+		return min(max(time.Duration(seconds)*time.Second, jwksMinRefreshInterval), jwksMaxRefreshInterval)
+	}
+
+	return jwksDefaultRefreshInterval
+}
@@ -0,0 +1,152 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// TokenVerifier verifies a bearer token and returns its claims. *Authenticator
+// implements it.
+type TokenVerifier interface {
+	VerifyClaims(ctx context.Context, token string, custom any) (*Claims, error)
+}
+
+type (
+	claimsContextKey struct{}
+	tokenContextKey  struct{}
+)
+
+// ContextWithClaims returns a copy of ctx carrying the verified claims.
+func ContextWithClaims(ctx context.Context, claims *Claims) context.Context {
+	return context.WithValue(ctx, claimsContextKey{}, claims)
+}
+
+// ClaimsFromContext returns the claims put on the context by Authenticate or
+// AuthenticateOptional. ok is false for anonymous requests.
+func ClaimsFromContext(ctx context.Context) (claims *Claims, ok bool) {
+	claims, ok = ctx.Value(claimsContextKey{}).(*Claims)
+	return claims, ok && claims != nil
+}
+
+// TokenFromContext returns the raw bearer token accepted by Authenticate or
+// AuthenticateOptional, e.g. to pass it on to Exchange.
+func TokenFromContext(ctx context.Context) (token string, ok bool) {
+	token, ok = ctx.Value(tokenContextKey{}).(string)
+	return token, ok && token != ""
+}
+
+// Authenticate returns middleware that requires an "Authorization: Bearer" token
+// accepted by v. Requests without a Bearer token, including those using another
+// scheme such as Basic, get 401, malformed Bearer headers 400 with
+// invalid_request and rejected tokens 401 with invalid_token, each with a
+// WWW-Authenticate challenge as described in RFC 6750. Tokens bound to a DPoP key
+// are rejected; see AuthenticateDPoP. The verified claims are
+// available to next through ClaimsFromContext and the token itself through
+// TokenFromContext.
+func Authenticate(v TokenVerifier) func(http.Handler) http.Handler {
+	return bearerAuth(v, false)
+}
+
+// AuthenticateOptional works like Authenticate but lets requests without an
+// Bearer token through anonymously, including those authorized with another
+// scheme. A Bearer token that is present must still be valid.
+func AuthenticateOptional(v TokenVerifier) func(http.Handler) http.Handler {
+	return bearerAuth(v, true)
+}
+
+func bearerAuth(v TokenVerifier, optional bool) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			token, err := bearerToken(r)
+			if err != nil {
+				writeBearerChallenge(w, http.StatusBadRequest, "invalid_request", err.Error())
+				return
+			}
+
+			if token == "" {
+				if optional {
+					next.ServeHTTP(w, r)
+					return
+				}
+				writeBearerChallenge(w, http.StatusUnauthorized, "", "")
+				return
+			}
+
+			claims, err := v.VerifyClaims(r.Context(), token, nil)
+			if err != nil {
+				writeBearerChallenge(w, http.StatusUnauthorized, "invalid_token", verifyErrorDescription(err))
+				return
+			}
+			if _, bound := claimAt(claims.Raw, "cnf.jkt").(string); bound {
+				// A token bound to a DPoP key is worthless to a thief only if its proof is required.
+				writeBearerChallenge(w, http.StatusUnauthorized, "invalid_token", "token is bound to a DPoP key")
+				return
+			}
+
+			ctx := context.WithValue(ContextWithClaims(r.Context(), claims), tokenContextKey{}, token)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// bearerToken extracts the token from the Authorization header. It returns an
+// empty token and no error when the header is absent or uses another scheme,
+// which carries no Bearer credentials to reject.
+func bearerToken(r *http.Request) (string, error) {
+	header := r.Header.Get("Authorization")
+	if header == "" {
+		return "", nil
+	}
+
+	scheme, token, _ := strings.Cut(header, " ")
+	if !strings.EqualFold(scheme, "Bearer") {
+		return "", nil
+	}
+
+	token = strings.TrimSpace(token)
+	if token == "" {
+		return "", errors.New("bearer token is empty")
+	}
+
+	return token, nil
+}
+
+// verifyErrorDescription maps a verification error to a description that is safe
+// to send back to the client.
+func verifyErrorDescription(err error) string {
+	for _, known := range []error{ErrTokenExpired, ErrTokenNotYetValid, ErrTokenWrongAudience, ErrTokenWrongIssuer, ErrTokenInactive} {
+		if errors.Is(err, known) {
+			return known.Error()
+		}
+	}
+	return "token is invalid"
+}
+
+// writeBearerChallenge responds with status and a Bearer WWW-Authenticate header
+// carrying the optional error code and description.
+func writeBearerChallenge(w http.ResponseWriter, status int, code, description string) {
+	writeChallenge(w, "Bearer", status, code, description)
+}
+
+// writeChallenge responds with status and a WWW-Authenticate header for scheme
+// carrying the optional error code and description.
+func writeChallenge(w http.ResponseWriter, scheme string, status int, code, description string) {
+	challenge := scheme
+
+	attrs := make([]string, 0, 2)
+	if code != "" {
+		attrs = append(attrs, fmt.Sprintf("error=%q", code))
+	}
+	if description != "" {
+		attrs = append(attrs, fmt.Sprintf("error_description=%q", description))
+	}
+	if len(attrs) > 0 {
+		challenge += " " + strings.Join(attrs, ", ")
+	}
+
+	w.Header().Set("WWW-Authenticate", challenge)
+	http.Error(w, http.StatusText(status), status)
+}
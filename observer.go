@@ -0,0 +1,248 @@
+package service
+
+import (
+	"errors"
+	"expvar"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+)
+
+// Observer receives events from an Authenticator, e.g. to export metrics. Its
+// methods are called synchronously from token requests, background refreshers and
+// verification, possibly concurrently, so they must be safe for concurrent use and
+// return quickly. Embed NopObserver to implement only some of them.
+type Observer interface {
+	// OnGrant is called after every request to the token endpoint.
+	OnGrant(GrantEvent)
+	// OnFallback is called when a refresh_token grant failed and the token is
+	// requested again with client_credentials.
+	OnFallback(FallbackEvent)
+	// OnJWKSReload is called after every JWKS fetch, scheduled or triggered by an
+	// unknown kid.
+	OnJWKSReload(JWKSReloadEvent)
+	// OnVerifyFailure is called when Verify, VerifyClaims or Introspect rejects a
+	// token.
+	OnVerifyFailure(VerifyFailureEvent)
+}
+
+// GrantEvent describes one request to the token endpoint.
+type GrantEvent struct {
+	// GrantType is the grant_type sent, e.g. client_credentials or refresh_token.
+	GrantType string
+	Duration  time.Duration
+	// Err is nil when a token was issued.
+	Err error
+}
+
+// FallbackEvent describes a fallback from the refresh_token grant to
+// client_credentials.
+type FallbackEvent struct {
+	// Err is why the refresh_token grant failed.
+	Err error
+}
+
+// JWKSReloadEvent describes one fetch of the JWKS.
+type JWKSReloadEvent struct {
+	Duration time.Duration
+	// Keys is the number of usable keys loaded, zero when Err is set.
+	Keys int
+	Err  error
+}
+
+// Reasons reported in VerifyFailureEvent.
+const (
+	VerifyReasonExpired           = "expired"
+	VerifyReasonNotYetValid       = "not_yet_valid"
+	VerifyReasonWrongIssuer       = "wrong_issuer"
+	VerifyReasonWrongAudience     = "wrong_audience"
+	VerifyReasonInactive          = "inactive"
+	VerifyReasonUnknownKeyID      = "unknown_kid"
+	VerifyReasonAlgorithmMismatch = "algorithm_mismatch"
+	VerifyReasonMalformed         = "malformed"
+	VerifyReasonInvalidSignature  = "invalid_signature"
+	VerifyReasonInvalidPayload    = "invalid_payload"
+	VerifyReasonOther             = "other"
+)
+
+// VerifyFailureEvent describes a rejected token.
+type VerifyFailureEvent struct {
+	// Reason is one of the VerifyReason constants, suitable as a metric label.
+	Reason string
+	Err    error
+}
+
+// NopObserver ignores every event. It is the default Observer.
+type NopObserver struct{}
+
+func (NopObserver) OnGrant(GrantEvent)                 {}
+func (NopObserver) OnFallback(FallbackEvent)           {}
+func (NopObserver) OnJWKSReload(JWKSReloadEvent)       {}
+func (NopObserver) OnVerifyFailure(VerifyFailureEvent) {}
+
+// verifyFailureReason classifies a verification error into a VerifyReason.
+func verifyFailureReason(err error) string {
+	for _, reason := range []struct {
+		err    error
+		reason string
+	}{
+		{ErrTokenExpired, VerifyReasonExpired},
+		{ErrTokenNotYetValid, VerifyReasonNotYetValid},
+		{ErrTokenWrongIssuer, VerifyReasonWrongIssuer},
+		{ErrTokenWrongAudience, VerifyReasonWrongAudience},
+		{ErrTokenInactive, VerifyReasonInactive},
+		{ErrUnknownKeyID, VerifyReasonUnknownKeyID},
+		{ErrKeyAlgorithmMismatch, VerifyReasonAlgorithmMismatch},
+		{ErrTokenMalformed, VerifyReasonMalformed},
+		{jose.ErrCryptoFailure, VerifyReasonInvalidSignature},
+		{ErrTokenInvalidPayload, VerifyReasonInvalidPayload},
+	} {
+		if errors.Is(err, reason.err) {
+			return reason.reason
+		}
+	}
+	return VerifyReasonOther
+}
+
+// observeVerify reports err, if any, to the observer and returns it unchanged.
+func (t *Authenticator) observeVerify(err error) error {
+	if err != nil {
+		t.observer.OnVerifyFailure(VerifyFailureEvent{Reason: verifyFailureReason(err), Err: err})
+	}
+	return err
+}
+
+// defaultLatencyBuckets are the upper bounds, in seconds, of the latency histograms
+// published by ExpvarObserver.
+var defaultLatencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// ExpvarObserver publishes Authenticator events as expvar counters and latency
+// histograms, served as JSON on /debug/vars. Under its name it publishes:
+//
+//	grants              requests per grant type
+//	grant_errors        failed requests per grant type
+//	grant_seconds       latency histogram per grant type
+//	fallbacks           refresh_token grants retried with client_credentials
+//	jwks_reloads        JWKS fetches
+//	jwks_reload_errors  failed JWKS fetches
+//	jwks_reload_seconds JWKS fetch latency histogram
+//	verify_failures     rejected tokens per VerifyReason
+type ExpvarObserver struct {
+	grants         *expvar.Map
+	grantErrors    *expvar.Map
+	grantSeconds   *expvar.Map
+	fallbacks      *expvar.Int
+	jwksReloads    *expvar.Int
+	jwksErrors     *expvar.Int
+	jwksSeconds    *histogram
+	verifyFailures *expvar.Map
+
+	mu sync.Mutex
+}
+
+// NewExpvarObserver creates an ExpvarObserver publishing an expvar.Map with the
+// given name. Like expvar.NewMap it panics if the name is already in use.
+func NewExpvarObserver(name string) *ExpvarObserver {
+	o := &ExpvarObserver{
+		grants:         new(expvar.Map),
+		grantErrors:    new(expvar.Map),
+		grantSeconds:   new(expvar.Map),
+		fallbacks:      new(expvar.Int),
+		jwksReloads:    new(expvar.Int),
+		jwksErrors:     new(expvar.Int),
+		jwksSeconds:    newHistogram(defaultLatencyBuckets),
+		verifyFailures: new(expvar.Map),
+	}
+
+	m := expvar.NewMap(name)
+	m.Set("grants", o.grants)
+	m.Set("grant_errors", o.grantErrors)
+	m.Set("grant_seconds", o.grantSeconds)
+	m.Set("fallbacks", o.fallbacks)
+	m.Set("jwks_reloads", o.jwksReloads)
+	m.Set("jwks_reload_errors", o.jwksErrors)
+	m.Set("jwks_reload_seconds", o.jwksSeconds)
+	m.Set("verify_failures", o.verifyFailures)
+
+	return o
+}
+
+func (o *ExpvarObserver) OnGrant(e GrantEvent) {
+	o.grants.Add(e.GrantType, 1)
+	if e.Err != nil {
+		o.grantErrors.Add(e.GrantType, 1)
+	}
+
+	o.mu.Lock()
+	h, ok := o.grantSeconds.Get(e.GrantType).(*histogram)
+	if !ok {
+		h = newHistogram(defaultLatencyBuckets)
+		o.grantSeconds.Set(e.GrantType, h)
+	}
+	o.mu.Unlock()
+	h.observe(e.Duration.Seconds())
+}
+
+func (o *ExpvarObserver) OnFallback(FallbackEvent) {
+	o.fallbacks.Add(1)
+}
+
+func (o *ExpvarObserver) OnJWKSReload(e JWKSReloadEvent) {
+	o.jwksReloads.Add(1)
+	if e.Err != nil {
+		o.jwksErrors.Add(1)
+	}
+	o.jwksSeconds.observe(e.Duration.Seconds())
+}
+
+func (o *ExpvarObserver) OnVerifyFailure(e VerifyFailureEvent) {
+	o.verifyFailures.Add(e.Reason, 1)
+}
+
+// histogram is an expvar.Var counting observations into cumulative buckets, in
+// the spirit of a Prometheus histogram.
+type histogram struct {
+	bounds []float64
+
+	mu     sync.Mutex
+	counts []uint64 // counts[i] observations <= bounds[i]; the last one is +Inf
+	count  uint64
+	sum    float64
+}
+
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]uint64, len(bounds)+1)}
+}
+
+func (h *histogram) observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for i, bound := range h.bounds {
+		if v <= bound {
+			h.counts[i]++
+		}
+	}
+	h.counts[len(h.bounds)]++
+	h.count++
+	h.sum += v
+}
+
+// String implements expvar.Var.
+func (h *histogram) String() string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	buckets := make([]string, 0, len(h.counts))
+	for i, bound := range h.bounds {
+		buckets = append(buckets, fmt.Sprintf("%q: %d", strconv.FormatFloat(bound, 'g', -1, 64), h.counts[i]))
+	}
+	buckets = append(buckets, fmt.Sprintf("%q: %d", "+Inf", h.counts[len(h.bounds)]))
+
+	return fmt.Sprintf(`{"count": %d, "sum": %s, "buckets": {%s}}`,
+		h.count, strconv.FormatFloat(h.sum, 'g', -1, 64), strings.Join(buckets, ", "))
+}
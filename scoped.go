@@ -0,0 +1,143 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/url"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// scopedToken is a token for one audience and scope set, requested with TokenFor.
+type scopedToken struct {
+	key    string
+	params url.Values
+
+	tk       atomic.Pointer[jwtToken]
+	mu       ctxMutex
+	lastUsed atomic.Int64
+	started  atomic.Bool
+}
+
+// TokenFor returns an access token for audience carrying scopes. Each audience
+// and scope set gets its own token, requested with the client_credentials grant's
+// audience and scope parameters, cached and refreshed in the background like the
+// main token. Tokens not asked for within the configured idle timeout are dropped
+// instead of being refreshed again.
+func (t *Authenticator) TokenFor(ctx context.Context, audience string, scopes ...string) (string, error) {
+	entry := t.scopedEntry(audience, scopes)
+	entry.lastUsed.Store(time.Now().UnixNano())
+
+	tk := entry.tk.Load()
+	if tk == nil || tk.expired() {
+		if err := t.refreshToken(ctx, &entry.mu, &entry.tk, tk, entry.params); err != nil {
+			if entry.tk.Load() == nil {
+				// Without a token there is no refresher to evict the entry later.
+				t.evictScoped(entry)
+			}
+			return "", err
+		}
+		tk = entry.tk.Load()
+	}
+
+	if tk == nil {
+		return "", errors.New("no token issued")
+	}
+
+	if !entry.started.Load() {
+		t.startScoped(entry)
+	}
+
+	return tk.AccessToken, nil
+}
+
+// scopedEntry returns the cache entry for audience and scopes, creating it when needed.
+func (t *Authenticator) scopedEntry(audience string, scopes []string) *scopedToken {
+	scopes = slices.Sorted(slices.Values(scopes))
+	key := audience + "\x00" + strings.Join(scopes, " ")
+
+	t.scopedMu.Lock()
+	defer t.scopedMu.Unlock()
+
+	entry, ok := t.scoped[key]
+	if !ok {
+		entry = &scopedToken{key: key, params: scopeParams(audience, scopes)}
+		t.scoped[key] = entry
+	}
+
+	return entry
+}
+
+// startScoped starts entry's background refresher once, unless Close has begun
+// or entry was replaced after a failed first grant.
+func (t *Authenticator) startScoped(entry *scopedToken) {
+	t.scopedMu.Lock()
+	defer t.scopedMu.Unlock()
+
+	if cur, ok := t.scoped[entry.key]; t.closed || (ok && cur != entry) {
+		return
+	}
+	if !entry.started.CompareAndSwap(false, true) {
+		return
+	}
+	// A concurrent caller may have evicted entry when its own grant failed.
+	t.scoped[entry.key] = entry
+
+	t.wg.Go(func() {
+		t.runScoped(entry)
+	})
+}
+
+// runScoped refreshes entry until it goes idle or the Authenticator's context is done.
+func (t *Authenticator) runScoped(entry *scopedToken) {
+	timer := time.NewTimer(t.refreshAfter(entry.tk.Load()))
+	defer timer.Stop()
+
+	failures := 0
+
+	for {
+		select {
+		case <-timer.C:
+			if time.Since(time.Unix(0, entry.lastUsed.Load())) > t.idleTimeout {
+				t.evictScoped(entry)
+				return
+			}
+
+			if err := t.refreshToken(t.ctx, &entry.mu, &entry.tk, entry.tk.Load(), entry.params); err != nil {
+				failures++
+				delay := t.retryAfter(failures)
+				log.Printf("[ERROR] failed to refresh token for %q, retrying in %s: %v", entry.key, delay.Round(time.Millisecond), err)
+				timer.Reset(delay)
+				continue
+			}
+			failures = 0
+			timer.Reset(t.refreshAfter(entry.tk.Load()))
+		case <-t.ctx.Done():
+			return
+		}
+	}
+}
+
+func (t *Authenticator) evictScoped(entry *scopedToken) {
+	t.scopedMu.Lock()
+	defer t.scopedMu.Unlock()
+
+	if t.scoped[entry.key] == entry {
+		delete(t.scoped, entry.key)
+	}
+}
+
+// scopeParams returns the client_credentials parameters requesting audience and scopes.
+func scopeParams(audience string, scopes []string) url.Values {
+	params := url.Values{}
+	if audience != "" {
+		params.Set("audience", audience)
+	}
+	if len(scopes) > 0 {
+		params.Set("scope", strings.Join(scopes, " "))
+	}
+	return params
+}
@@ -3,11 +3,40 @@ package service
 import (
 	"bytes"
 	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-jose/go-jose/v4"
+	josejwt "github.com/go-jose/go-jose/v4/jwt"
 	"github.com/pkgz/logg"
+	"github.com/pkgz/service/servicetest"
 	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"io"
 	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"testing"
 	"time"
@@ -167,3 +196,1579 @@ func TestNewMongo(t *testing.T) {
 	require.Error(t, err)
 	require.Nil(t, client)
 }
+
+func TestAuthenticator_Verify(t *testing.T) {
+	oldKey, newKey := testRSAKey(t), testRSAKey(t)
+	srv := newTestAuthServer(t, map[string]crypto.Signer{"old": oldKey, "new": newKey})
+
+	auth, err := NewAuthenticator(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, "token-1", auth.Token())
+	require.Len(t, auth.jwks.current().Keys, 2)
+
+	t.Run("kid selects key", func(t *testing.T) {
+		payload, err := auth.Verify(testSign(t, newKey, "new", `{"sub":"1"}`))
+		require.NoError(t, err)
+		require.JSONEq(t, `{"sub":"1"}`, string(payload))
+
+		_, err = auth.Verify(testSign(t, oldKey, "new", `{"sub":"1"}`))
+		require.Error(t, err)
+	})
+
+	t.Run("no kid tries all keys", func(t *testing.T) {
+		_, err := auth.Verify(testSign(t, oldKey, "", `{"sub":"1"}`))
+		require.NoError(t, err)
+		_, err = auth.Verify(testSign(t, testRSAKey(t), "", `{"sub":"1"}`))
+		require.Error(t, err)
+	})
+
+	t.Run("unknown kid", func(t *testing.T) {
+		_, err := auth.Verify(testSign(t, oldKey, "missing", `{"sub":"1"}`))
+		require.ErrorIs(t, err, ErrUnknownKeyID)
+	})
+
+	t.Run("pinned key", func(t *testing.T) {
+		t.Setenv("AUTH_HOST", srv.URL)
+		t.Setenv("JWKS_KEY_ID", "old")
+		auth, err := NewAuthenticator(context.Background())
+		require.NoError(t, err)
+		require.Len(t, auth.jwks.current().Keys, 1)
+
+		t.Setenv("JWKS_KEY_ID", "other")
+		_, err = NewAuthenticator(context.Background())
+		require.Error(t, err)
+	})
+}
+
+func TestAuthenticator_JWKSRotation(t *testing.T) {
+	oldKey, newKey := testRSAKey(t), testRSAKey(t)
+	srv := newTestAuthServer(t, map[string]crypto.Signer{"old": oldKey})
+
+	auth, err := NewAuthenticator(context.Background())
+	require.NoError(t, err)
+	require.EqualValues(t, 1, srv.Requests(servicetest.JWKSPath))
+
+	// The first lookup of an unknown kid is rate-limited by the initial load.
+	auth.jwks.fetchedAt = time.Now().Add(-jwksRefetchInterval)
+	srv.AddKey("new", newKey)
+
+	_, err = auth.Verify(testSign(t, newKey, "new", `{}`))
+	require.NoError(t, err)
+	require.EqualValues(t, 2, srv.Requests(servicetest.JWKSPath))
+
+	_, err = auth.Verify(testSign(t, newKey, "newer", `{}`))
+	require.ErrorIs(t, err, ErrUnknownKeyID)
+	require.EqualValues(t, 2, srv.Requests(servicetest.JWKSPath), "refetch must be rate-limited")
+}
+
+func TestAuthenticator_VerifyClaims(t *testing.T) {
+	key := testRSAKey(t)
+	newTestAuthServer(t, map[string]crypto.Signer{"k": key})
+
+	auth, err := NewAuthenticator(context.Background())
+	require.NoError(t, err)
+	auth.Issuers = []string{"https://issuer"}
+	auth.Audiences = []string{"api", "admin"}
+
+	now := time.Now().Unix()
+	sign := func(claims map[string]any) string {
+		payload, err := json.Marshal(claims)
+		require.NoError(t, err)
+		return testSign(t, key, "k", string(payload))
+	}
+
+	var custom struct {
+		Email string `json:"email"`
+	}
+	claims, err := auth.VerifyClaims(context.Background(), sign(map[string]any{
+		"iss": "https://issuer", "aud": []string{"other", "api"}, "sub": "42", "exp": now + 60, "email": "a@b.c",
+	}), &custom)
+	require.NoError(t, err)
+	require.Equal(t, "42", claims.Subject)
+	require.Equal(t, "a@b.c", custom.Email)
+
+	for name, tc := range map[string]struct {
+		claims map[string]any
+		err    error
+	}{
+		"expired":          {map[string]any{"iss": "https://issuer", "aud": "api", "exp": now - 120}, ErrTokenExpired},
+		"not before":       {map[string]any{"iss": "https://issuer", "aud": "api", "nbf": now + 120}, ErrTokenNotYetValid},
+		"issued in future": {map[string]any{"iss": "https://issuer", "aud": "api", "iat": now + 120}, ErrTokenNotYetValid},
+		"wrong issuer":     {map[string]any{"iss": "https://other", "aud": "api"}, ErrTokenWrongIssuer},
+		"wrong audience":   {map[string]any{"iss": "https://issuer", "aud": "web"}, ErrTokenWrongAudience},
+		"no audience":      {map[string]any{"iss": "https://issuer"}, ErrTokenWrongAudience},
+		"invalid payload":  {map[string]any{"iss": "https://issuer", "exp": "soon"}, ErrTokenInvalidPayload},
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := auth.VerifyClaims(context.Background(), sign(tc.claims), nil)
+			require.ErrorIs(t, err, tc.err)
+		})
+	}
+
+	t.Run("leeway", func(t *testing.T) {
+		_, err := auth.VerifyClaims(context.Background(), sign(map[string]any{"iss": "https://issuer", "aud": "api", "exp": now - 30}), nil)
+		require.NoError(t, err)
+	})
+}
+
+func TestAuthenticator_Algorithms(t *testing.T) {
+	rsaKey := testRSAKey(t)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	newTestAuthServer(t, map[string]crypto.Signer{"rsa": rsaKey, "ec": ecKey, "ed": edKey})
+
+	auth, err := NewAuthenticator(context.Background())
+	require.NoError(t, err)
+	require.Len(t, auth.jwks.current().Keys, 3)
+
+	_, err = auth.Verify(testSignWith(t, jose.ES256, ecKey, "ec", `{}`))
+	require.Error(t, err, "ES256 is not allowed by default")
+
+	auth.Algorithms = []jose.SignatureAlgorithm{jose.RS256, jose.PS256, jose.ES256, jose.EdDSA}
+
+	for _, tc := range []struct {
+		alg jose.SignatureAlgorithm
+		key crypto.Signer
+		kid string
+	}{
+		{jose.RS256, rsaKey, "rsa"},
+		{jose.PS256, rsaKey, "rsa"},
+		{jose.ES256, ecKey, "ec"},
+		{jose.EdDSA, edKey, "ed"},
+		{jose.ES256, ecKey, ""},
+	} {
+		_, err := auth.Verify(testSignWith(t, tc.alg, tc.key, tc.kid, `{}`))
+		require.NoError(t, err, tc.alg)
+	}
+
+	_, err = auth.Verify(testSignWith(t, jose.RS256, rsaKey, "ec", `{}`))
+	require.ErrorIs(t, err, ErrKeyAlgorithmMismatch)
+	_, err = auth.Verify(testSignWith(t, jose.EdDSA, edKey, "rsa", `{}`))
+	require.ErrorIs(t, err, ErrKeyAlgorithmMismatch)
+}
+
+func TestAuthenticate(t *testing.T) {
+	key := testRSAKey(t)
+	newTestAuthServer(t, map[string]crypto.Signer{"k": key})
+
+	auth, err := NewAuthenticator(context.Background())
+	require.NoError(t, err)
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if claims, ok := ClaimsFromContext(r.Context()); ok {
+			_, _ = w.Write([]byte(claims.Subject))
+			return
+		}
+		_, _ = w.Write([]byte("anonymous"))
+	})
+
+	valid := testSign(t, key, "k", `{"sub":"42"}`)
+	expired := testSign(t, key, "k", fmt.Sprintf(`{"sub":"42","exp":%d}`, time.Now().Add(-time.Hour).Unix()))
+
+	for name, tc := range map[string]struct {
+		optional  bool
+		header    string
+		status    int
+		body      string
+		challenge string
+	}{
+		"valid":             {header: "Bearer " + valid, status: http.StatusOK, body: "42"},
+		"lowercase scheme":  {header: "bearer " + valid, status: http.StatusOK, body: "42"},
+		"missing":           {status: http.StatusUnauthorized, challenge: `Bearer`},
+		"other scheme":      {header: "Basic Zm9vOmJhcg==", status: http.StatusUnauthorized, challenge: `Bearer`},
+		"empty token":       {header: "Bearer ", status: http.StatusBadRequest, challenge: `Bearer error="invalid_request", error_description="bearer token is empty"`},
+		"scheme only":       {header: "Bearer", status: http.StatusBadRequest, challenge: `Bearer error="invalid_request", error_description="bearer token is empty"`},
+		"expired":           {header: "Bearer " + expired, status: http.StatusUnauthorized, challenge: `Bearer error="invalid_token", error_description="token is expired"`},
+		"garbage":           {header: "Bearer abc", status: http.StatusUnauthorized, challenge: `Bearer error="invalid_token", error_description="token is invalid"`},
+		"optional missing":  {optional: true, status: http.StatusOK, body: "anonymous"},
+		"optional valid":    {optional: true, header: "Bearer " + valid, status: http.StatusOK, body: "42"},
+		"optional other":    {optional: true, header: "Basic Zm9vOmJhcg==", status: http.StatusOK, body: "anonymous"},
+		"optional empty":    {optional: true, header: "Bearer ", status: http.StatusBadRequest},
+		"optional rejected": {optional: true, header: "Bearer abc", status: http.StatusUnauthorized},
+	} {
+		t.Run(name, func(t *testing.T) {
+			mw := Authenticate(auth)
+			if tc.optional {
+				mw = AuthenticateOptional(auth)
+			}
+
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tc.header != "" {
+				r.Header.Set("Authorization", tc.header)
+			}
+			w := httptest.NewRecorder()
+			mw(handler).ServeHTTP(w, r)
+
+			require.Equal(t, tc.status, w.Code)
+			if tc.body != "" {
+				require.Equal(t, tc.body, w.Body.String())
+			}
+			if tc.challenge != "" {
+				require.Equal(t, tc.challenge, w.Header().Get("WWW-Authenticate"))
+			}
+		})
+	}
+}
+
+func TestRequirements(t *testing.T) {
+	var claims Claims
+	require.NoError(t, json.Unmarshal([]byte(`{
+		"sub": "42", "scope": "orders:read orders:write",
+		"realm_access": {"roles": ["admin"]},
+		"https://example.com/roles": ["editor"],
+		"resource_access": {"orders": {"roles": "viewer"}}
+	}`), &claims))
+	require.Equal(t, "42", claims.Raw["sub"])
+
+	require.NoError(t, RequireScopes("orders:read", "orders:write")(&claims))
+	require.ErrorIs(t, RequireScopes("orders:read", "billing")(&claims), ErrInsufficientScope)
+
+	require.NoError(t, RequireAnyRole("admin")(&claims))
+	require.ErrorIs(t, RequireAnyRole("editor")(&claims), ErrInsufficientScope)
+	require.NoError(t, RolePaths{"https://example.com/roles"}.RequireAny("editor", "owner")(&claims))
+	require.Equal(t, []string{"viewer"}, RolePaths{"resource_access.orders.roles"}.Roles(&claims))
+	require.Empty(t, RolePaths{"resource_access.billing.roles", "sub.x"}.Roles(&claims))
+
+	require.NoError(t, Require("subject 42", func(c *Claims) bool { return c.Subject == "42" })(&claims))
+	require.ErrorIs(t, Require("subject 7", func(c *Claims) bool { return c.Subject == "7" })(&claims), ErrInsufficientScope)
+
+	t.Run("middleware", func(t *testing.T) {
+		srv := newTestAuthServer(t, nil)
+		auth, err := NewAuthenticator(context.Background())
+		require.NoError(t, err)
+
+		handler := Authenticate(auth)(RequireScopes("orders:write").Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte("ok"))
+		})))
+
+		for name, tc := range map[string]struct {
+			scope     string
+			status    int
+			challenge string
+		}{
+			"granted": {scope: "orders:read orders:write", status: http.StatusOK},
+			"missing": {scope: "orders:read", status: http.StatusForbidden, challenge: `Bearer error="insufficient_scope", error_description="insufficient scope: scope \"orders:write\" is required"`},
+		} {
+			t.Run(name, func(t *testing.T) {
+				r := httptest.NewRequest(http.MethodGet, "/", nil)
+				r.Header.Set("Authorization", "Bearer "+srv.Mint(map[string]any{"scope": tc.scope}, time.Minute))
+				w := httptest.NewRecorder()
+				handler.ServeHTTP(w, r)
+
+				require.Equal(t, tc.status, w.Code)
+				require.Equal(t, tc.challenge, w.Header().Get("WWW-Authenticate"))
+			})
+		}
+
+		w := httptest.NewRecorder()
+		RequireAnyRole("admin").Middleware(http.NotFoundHandler()).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+		require.Equal(t, http.StatusUnauthorized, w.Code, "no claims on the context")
+	})
+}
+
+func TestTransport(t *testing.T) {
+	srv := newTestAuthServer(t, map[string]crypto.Signer{"k": testRSAKey(t)})
+
+	auth, err := NewAuthenticator(context.Background())
+	require.NoError(t, err)
+
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token-2" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		_, _ = w.Write(body)
+	}))
+	defer api.Close()
+
+	client := auth.Client()
+
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := client.Post(api.URL, "text/plain", strings.NewReader("payload"))
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			body, _ := io.ReadAll(resp.Body)
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+			require.Equal(t, "payload", string(body))
+		}()
+	}
+	wg.Wait()
+	require.EqualValues(t, 2, srv.Issued(), "concurrent 401s must share one refresh")
+
+	t.Run("body without GetBody", func(t *testing.T) {
+		auth.tk.Store(&jwtToken{AccessToken: "stale"})
+
+		req, err := http.NewRequest(http.MethodPost, api.URL, io.NopCloser(strings.NewReader("payload")))
+		require.NoError(t, err)
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+		require.EqualValues(t, 2, srv.Issued())
+	})
+}
+
+func TestAuthenticator_Discovery(t *testing.T) {
+	key := testRSAKey(t)
+	srv := newTestAuthServer(t, map[string]crypto.Signer{"k": key})
+
+	t.Run("openid configuration", func(t *testing.T) {
+		realm := servicetest.NewServer(t, servicetest.Options{
+			Keys: map[string]crypto.Signer{"k": key}, BasePath: "/realms/test", Discovery: true,
+		})
+		t.Setenv("AUTH_HOST", realm.Issuer())
+		auth, err := NewAuthenticator(context.Background())
+		require.NoError(t, err)
+		require.Equal(t, realm.URL+"/realms/test/token", auth.TokenEndpoint)
+		require.Equal(t, realm.URL+"/realms/test/.well-known/jwks.json", auth.JWKSURI)
+		require.Equal(t, []string{realm.URL + "/realms/test"}, auth.Issuers)
+
+		_, err = auth.VerifyClaims(context.Background(), realm.Mint(nil, time.Minute), nil)
+		require.NoError(t, err)
+		_, err = auth.VerifyClaims(context.Background(), testSign(t, key, "k", `{"iss":"https://other"}`), nil)
+		require.ErrorIs(t, err, ErrTokenWrongIssuer)
+	})
+
+	t.Run("fallback without discovery", func(t *testing.T) {
+		auth, err := NewAuthenticator(context.Background())
+		require.NoError(t, err)
+		require.Equal(t, srv.URL+"/token", auth.TokenEndpoint)
+		require.Equal(t, srv.URL+"/.well-known/jwks.json", auth.JWKSURI)
+		require.Empty(t, auth.Issuers)
+	})
+
+	for name, resp := range map[string]struct {
+		status int
+		body   string
+	}{
+		"fallback on forbidden":   {status: http.StatusForbidden, body: `{"error":"forbidden"}`},
+		"fallback on html":        {status: http.StatusOK, body: `<!doctype html><html></html>`},
+		"fallback on gateway 400": {status: http.StatusBadRequest},
+	} {
+		t.Run(name, func(t *testing.T) {
+			client := &http.Client{Transport: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+				if r.URL.Path == servicetest.DiscoveryPath {
+					return &http.Response{StatusCode: resp.status, Body: io.NopCloser(strings.NewReader(resp.body)), Request: r}, nil
+				}
+				return http.DefaultTransport.RoundTrip(r)
+			})}
+
+			auth, err := NewAuthenticatorWithConfig(context.Background(), AuthConfig{
+				Host: srv.URL, ClientID: "client", ClientSecret: "secret", HTTPClient: client,
+			})
+			require.NoError(t, err)
+			require.Equal(t, srv.URL+"/token", auth.TokenEndpoint)
+			require.Equal(t, srv.URL+"/.well-known/jwks.json", auth.JWKSURI)
+		})
+	}
+
+	t.Run("explicit endpoints", func(t *testing.T) {
+		t.Setenv("AUTH_HOST", "http://127.0.0.1:1")
+		t.Setenv("AUTH_TOKEN_ENDPOINT", srv.URL+"/token")
+		t.Setenv("AUTH_JWKS_URI", srv.URL+"/.well-known/jwks.json")
+		auth, err := NewAuthenticator(context.Background())
+		require.NoError(t, err)
+		require.Equal(t, srv.URL+"/token", auth.TokenEndpoint)
+	})
+}
+
+func TestNewAuthenticatorWithConfig(t *testing.T) {
+	srv := newTestAuthServer(t, map[string]crypto.Signer{"k": testRSAKey(t)})
+
+	t.Run("args", func(t *testing.T) {
+		os.Args = []string{"", "--auth-scope=read", "--auth-audience=api", "--auth-verify-mode=auto", "--auth-revoke-on-close"}
+		var args struct {
+			ARGS
+			AuthArgs
+		}
+		require.NoError(t, ParseEnv(&args))
+
+		cfg := args.Config()
+		require.Equal(t, srv.URL, cfg.Host)
+		require.Equal(t, "client", cfg.ClientID)
+		require.Equal(t, []string{"read"}, cfg.Scopes)
+		require.Equal(t, []string{"api"}, cfg.Audiences)
+		require.Equal(t, time.Minute, cfg.Timeout)
+		require.Equal(t, VerifyAuto, cfg.VerifyMode)
+		require.True(t, cfg.RevokeOnClose)
+	})
+
+	t.Run("config", func(t *testing.T) {
+		var used atomic.Int32
+		client := &http.Client{Transport: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+			used.Add(1)
+			return http.DefaultTransport.RoundTrip(r)
+		})}
+
+		auth, err := NewAuthenticatorWithConfig(context.Background(), AuthConfig{
+			TokenEndpoint: srv.URL + "/token",
+			JWKSURI:       srv.URL + "/.well-known/jwks.json",
+			ClientID:      "other",
+			ClientSecret:  "secret",
+			Scopes:        []string{"read", "write"},
+			HTTPClient:    client,
+			RefreshRatio:  0.5,
+		})
+		require.NoError(t, err)
+		require.EqualValues(t, 2, used.Load(), "token and JWKS requests use the configured transport")
+		require.Equal(t, "read write", srv.LastRequest(servicetest.TokenPath).PostForm.Get("scope"))
+		require.Equal(t, "other", srv.LastRequest(servicetest.TokenPath).PostForm.Get("client_id"))
+		require.InDelta(t, 30*time.Minute, auth.refreshInterval(), float64(time.Second))
+		require.Equal(t, DefaultLeeway, auth.Leeway)
+	})
+
+	t.Run("missing host", func(t *testing.T) {
+		_, err := NewAuthenticatorWithConfig(context.Background(), AuthConfig{ClientID: "c", ClientSecret: "s"})
+		require.ErrorIs(t, err, ErrAuthHostNotFound)
+	})
+}
+
+func TestAuthenticator_ClientAuth(t *testing.T) {
+	srv := newTestAuthServer(t, map[string]crypto.Signer{"k": testRSAKey(t)})
+
+	t.Run("client_secret_basic", func(t *testing.T) {
+		_, err := NewAuthenticatorWithConfig(context.Background(), AuthConfig{
+			Host: srv.URL, ClientID: "my client", ClientSecret: "s3cr=t", AuthMethod: ClientSecretBasic,
+		})
+		require.NoError(t, err)
+
+		r := srv.LastRequest(servicetest.TokenPath)
+		id, secret, ok := r.BasicAuth()
+		require.True(t, ok)
+		require.Equal(t, "my+client", id)
+		require.Equal(t, "s3cr%3Dt", secret)
+		require.Empty(t, r.PostForm.Get("client_secret"))
+	})
+
+	t.Run("private_key_jwt", func(t *testing.T) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		require.NoError(t, err)
+
+		_, err = NewAuthenticatorWithConfig(context.Background(), AuthConfig{
+			Host: srv.URL, ClientID: "client", AuthMethod: PrivateKeyJWT, PrivateKey: key, PrivateKeyID: "client-key",
+		})
+		require.NoError(t, err)
+
+		r := srv.LastRequest(servicetest.TokenPath)
+		require.Empty(t, r.PostForm.Get("client_secret"))
+		require.Equal(t, "urn:ietf:params:oauth:client-assertion-type:jwt-bearer", r.PostForm.Get("client_assertion_type"))
+
+		assertion, err := josejwt.ParseSigned(r.PostForm.Get("client_assertion"), []jose.SignatureAlgorithm{jose.ES256})
+		require.NoError(t, err)
+		require.Equal(t, "client-key", assertion.Headers[0].KeyID)
+
+		var claims josejwt.Claims
+		require.NoError(t, assertion.Claims(key.Public(), &claims))
+		require.NoError(t, claims.Validate(josejwt.Expected{Issuer: "client", Subject: "client", AnyAudience: []string{srv.URL + "/token"}}))
+		require.NotEmpty(t, claims.ID)
+	})
+
+	t.Run("private_key_jwt without key", func(t *testing.T) {
+		_, err := NewAuthenticatorWithConfig(context.Background(), AuthConfig{Host: srv.URL, ClientID: "client", AuthMethod: PrivateKeyJWT})
+		require.ErrorIs(t, err, ErrAuthPrivateKeyNotFound)
+	})
+}
+
+func TestAuthenticator_TokenFor(t *testing.T) {
+	srv := newTestAuthServer(t, map[string]crypto.Signer{"k": testRSAKey(t)})
+
+	auth, err := NewAuthenticator(context.Background())
+	require.NoError(t, err)
+	require.EqualValues(t, 1, srv.Issued())
+
+	tk, err := auth.TokenFor(context.Background(), "orders", "write", "read")
+	require.NoError(t, err)
+	require.Equal(t, "token-2", tk)
+	require.Equal(t, "orders", srv.LastRequest(servicetest.TokenPath).PostForm.Get("audience"))
+	require.Equal(t, "read write", srv.LastRequest(servicetest.TokenPath).PostForm.Get("scope"))
+
+	tk, err = auth.TokenFor(context.Background(), "orders", "read", "write")
+	require.NoError(t, err)
+	require.Equal(t, "token-2", tk, "scope order does not matter")
+
+	tk, err = auth.TokenFor(context.Background(), "billing")
+	require.NoError(t, err)
+	require.Equal(t, "token-3", tk)
+	require.Equal(t, "token-1", auth.Token())
+
+	t.Run("idle tokens are evicted", func(t *testing.T) {
+		srv.SetTokenTTL(time.Second)
+		auth.idleTimeout = 0
+
+		_, err := auth.TokenFor(context.Background(), "reports")
+		require.NoError(t, err)
+
+		require.Eventually(t, func() bool {
+			auth.scopedMu.Lock()
+			defer auth.scopedMu.Unlock()
+			_, ok := auth.scoped["reports\x00"]
+			return !ok
+		}, 5*time.Second, 50*time.Millisecond)
+	})
+
+	t.Run("failed grants are not cached", func(t *testing.T) {
+		for i := range 5 {
+			srv.Fail(servicetest.TokenPath, 1, http.StatusBadRequest)
+			_, err := auth.TokenFor(context.Background(), fmt.Sprintf("unknown-%d", i))
+			require.Error(t, err)
+		}
+
+		auth.scopedMu.Lock()
+		defer auth.scopedMu.Unlock()
+		for key := range auth.scoped {
+			require.False(t, strings.HasPrefix(key, "unknown-"), "entry %q is left behind", key)
+		}
+	})
+}
+
+func TestAuthenticator_Exchange(t *testing.T) {
+	srv := newTestAuthServer(t, map[string]crypto.Signer{"k": testRSAKey(t)})
+
+	auth, err := NewAuthenticator(context.Background())
+	require.NoError(t, err)
+
+	tk, err := auth.Exchange(context.Background(), "user-token", "orders", []string{"read"})
+	require.NoError(t, err)
+	require.Equal(t, "token-2", tk)
+
+	form := srv.LastRequest(servicetest.TokenPath).PostForm
+	require.Equal(t, "urn:ietf:params:oauth:grant-type:token-exchange", form.Get("grant_type"))
+	require.Equal(t, "user-token", form.Get("subject_token"))
+	require.Equal(t, "urn:ietf:params:oauth:token-type:access_token", form.Get("subject_token_type"))
+	require.Equal(t, "orders", form.Get("audience"))
+	require.Equal(t, "read", form.Get("scope"))
+	require.Equal(t, "client", form.Get("client_id"))
+
+	tk, err = auth.Exchange(context.Background(), "user-token", "orders", []string{"read"})
+	require.NoError(t, err)
+	require.Equal(t, "token-2", tk)
+
+	tk, err = auth.Exchange(context.Background(), "other-user-token", "orders", []string{"read"})
+	require.NoError(t, err)
+	require.Equal(t, "token-3", tk)
+
+	_, err = auth.Exchange(context.Background(), "", "orders", nil)
+	require.Error(t, err)
+
+	t.Run("negative cache sizes", func(t *testing.T) {
+		auth, err := NewAuthenticatorWithConfig(context.Background(), AuthConfig{
+			Host: srv.URL, ClientID: "client", ClientSecret: "secret",
+			ExchangeCacheSize: -1, IntrospectionCacheSize: -1,
+		})
+		require.NoError(t, err)
+
+		for range 2 {
+			_, err = auth.Exchange(context.Background(), "user-token", "orders", nil)
+			require.NoError(t, err)
+			_, err = auth.Introspect(context.Background(), srv.MintOpaque(map[string]any{"sub": "42"}, time.Hour))
+			require.NoError(t, err)
+		}
+	})
+}
+
+func TestAuthenticator_Introspect(t *testing.T) {
+	key := testRSAKey(t)
+	srv := newTestAuthServer(t, map[string]crypto.Signer{"k": key})
+
+	auth, err := NewAuthenticatorWithConfig(context.Background(), AuthConfig{
+		Host: srv.URL, ClientID: "client", ClientSecret: "secret", VerifyMode: VerifyAuto,
+	})
+	require.NoError(t, err)
+	require.Equal(t, srv.URL+"/introspect", auth.IntrospectionEndpoint)
+
+	var custom struct {
+		Username string `json:"username"`
+	}
+	opaque := srv.MintOpaque(map[string]any{"sub": "42", "scope": "read", "username": "jdoe"}, time.Hour)
+	claims, err := auth.VerifyClaims(context.Background(), opaque, &custom)
+	require.NoError(t, err)
+	require.Equal(t, "42", claims.Subject)
+	require.Equal(t, "read", claims.Scope)
+	require.Equal(t, "jdoe", custom.Username)
+
+	_, err = auth.Introspect(context.Background(), opaque)
+	require.NoError(t, err)
+	require.EqualValues(t, 1, srv.Requests(servicetest.IntrospectionPath), "active result is cached")
+
+	_, err = auth.VerifyClaims(context.Background(), "revoked", nil)
+	require.ErrorIs(t, err, ErrTokenInactive)
+	_, err = auth.VerifyClaims(context.Background(), "revoked", nil)
+	require.ErrorIs(t, err, ErrTokenInactive)
+	require.EqualValues(t, 3, srv.Requests(servicetest.IntrospectionPath), "inactive result is not cached")
+
+	claims, err = auth.VerifyClaims(context.Background(), testSign(t, key, "k", `{"sub":"jwt"}`), nil)
+	require.NoError(t, err)
+	require.Equal(t, "jwt", claims.Subject)
+	require.EqualValues(t, 3, srv.Requests(servicetest.IntrospectionPath), "JWTs are verified locally")
+}
+
+func TestAuthenticator_Close(t *testing.T) {
+	srv := newTestAuthServer(t, map[string]crypto.Signer{"k": testRSAKey(t)})
+	running := goleak.IgnoreCurrent()
+
+	auth, err := NewAuthenticatorWithConfig(context.Background(), AuthConfig{
+		Host: srv.URL, ClientID: "client", ClientSecret: "secret", RevokeOnClose: true,
+	})
+	require.NoError(t, err)
+
+	_, err = auth.TokenFor(context.Background(), "orders")
+	require.NoError(t, err)
+
+	require.NoError(t, auth.Close(context.Background()))
+	require.NoError(t, auth.Close(context.Background()))
+	goleak.VerifyNone(t, running)
+
+	require.ElementsMatch(t, []string{
+		"refresh_token:refresh-1", "access_token:token-1",
+		"refresh_token:refresh-2", "access_token:token-2",
+	}, srv.Revoked())
+
+	_, err = auth.TokenFor(context.Background(), "billing")
+	require.NoError(t, err, "tokens can still be fetched on demand, without refreshers")
+
+	t.Run("expired context", func(t *testing.T) {
+		auth, err := NewAuthenticatorWithConfig(context.Background(), AuthConfig{
+			Host: srv.URL, ClientID: "client", ClientSecret: "secret", RevokeOnClose: true,
+		})
+		require.NoError(t, err)
+		revoked := len(srv.Revoked())
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		require.ErrorIs(t, auth.Close(ctx), context.Canceled)
+		require.Len(t, srv.Revoked(), revoked, "nothing is revoked with a done context")
+
+		require.NoError(t, auth.Close(context.Background()))
+		require.Len(t, srv.Revoked(), revoked+2, "a retried Close revokes the tokens")
+		require.NoError(t, auth.Close(context.Background()))
+		require.Len(t, srv.Revoked(), revoked+2)
+	})
+}
+
+func TestAuthenticator_TokenStore(t *testing.T) {
+	mr := miniredis.RunT(t)
+	ring, err := NewRedis(context.Background(), []string{mr.Addr()}, "")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = ring.Close() })
+
+	fileStore, err := NewFileTokenStore(t.TempDir())
+	require.NoError(t, err)
+
+	for name, store := range map[string]TokenStore{
+		"redis": NewRedisTokenStore(ring, "test:"),
+		"file":  fileStore,
+	} {
+		t.Run(name, func(t *testing.T) {
+			srv := newTestAuthServer(t, map[string]crypto.Signer{"k": testRSAKey(t)})
+			cfg := AuthConfig{Host: srv.URL, ClientID: "client", ClientSecret: "secret", TokenStore: store}
+
+			first, err := NewAuthenticatorWithConfig(context.Background(), cfg)
+			require.NoError(t, err)
+			second, err := NewAuthenticatorWithConfig(context.Background(), cfg)
+			require.NoError(t, err)
+			require.Equal(t, "token-1", second.Token(), "replica reuses the stored token")
+			require.EqualValues(t, 1, srv.Issued())
+
+			require.True(t, first.Refresh(context.Background()))
+			require.Equal(t, "token-2", first.Token())
+			require.True(t, second.Refresh(context.Background()))
+			require.Equal(t, "token-2", second.Token(), "forced refresh adopts the newer stored token")
+			require.True(t, second.Refresh(context.Background()))
+			require.Equal(t, "token-3", second.Token(), "forced refresh of the stored token runs a grant")
+
+			unlock, err := store.Lock(context.Background(), "lock", time.Minute)
+			require.NoError(t, err)
+			_, err = store.Lock(context.Background(), "lock", time.Minute)
+			require.ErrorIs(t, err, ErrTokenStoreLocked)
+			require.NoError(t, unlock(context.Background()))
+			unlock, err = store.Lock(context.Background(), "lock", time.Minute)
+			require.NoError(t, err)
+			require.NoError(t, unlock(context.Background()))
+		})
+	}
+}
+
+func TestAuthenticator_Status(t *testing.T) {
+	srv := newTestAuthServer(t, map[string]crypto.Signer{"k": testRSAKey(t)})
+
+	var failing atomic.Bool
+	client := &http.Client{Transport: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		if failing.Load() && r.URL.Path == "/token" {
+			return nil, errors.New("connection refused")
+		}
+		return http.DefaultTransport.RoundTrip(r)
+	})}
+
+	auth, err := NewAuthenticatorWithConfig(context.Background(), AuthConfig{
+		Host:         srv.URL,
+		ClientID:     "client",
+		ClientSecret: "secret",
+		HTTPClient:   client,
+		RetryMin:     100 * time.Millisecond,
+		RetryMax:     time.Second,
+	})
+	require.NoError(t, err)
+
+	status := auth.Status()
+	require.False(t, status.LastSuccess.IsZero())
+	require.Zero(t, status.Failures)
+	require.InDelta(t, time.Hour, status.ExpiresIn, float64(time.Second))
+	require.True(t, status.Ready(time.Minute))
+	require.False(t, status.Ready(2*time.Hour), "token expires within the margin")
+
+	failing.Store(true)
+	require.False(t, auth.Refresh(context.Background()))
+	require.False(t, auth.Refresh(context.Background()))
+	status = auth.Status()
+	require.Equal(t, 2, status.Failures)
+	require.ErrorContains(t, status.LastError, "connection refused")
+	require.True(t, status.Ready(time.Minute), "current token is still valid")
+
+	failing.Store(false)
+	require.True(t, auth.Refresh(context.Background()))
+	status = auth.Status()
+	require.Zero(t, status.Failures)
+	require.Error(t, status.LastError, "last error is kept after recovering")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	failing.Store(true)
+	require.False(t, auth.Refresh(ctx))
+	require.Zero(t, auth.Status().Failures, "a cancelled caller is not a failed refresh")
+	failing.Store(false)
+
+	for failures, ceiling := range map[int]time.Duration{
+		1:  100 * time.Millisecond,
+		3:  400 * time.Millisecond,
+		10: time.Second,
+		80: time.Second,
+	} {
+		for range 50 {
+			delay := auth.retryAfter(failures)
+			require.Positive(t, delay)
+			require.LessOrEqual(t, delay, ceiling)
+		}
+	}
+}
+
+func TestAuthenticator_TokenContext(t *testing.T) {
+	srv := newTestAuthServer(t, map[string]crypto.Signer{"k": testRSAKey(t)})
+	srv.SetTokenTTL(5 * time.Second) // within tokenExpiryLeeway, so every token is already expired
+
+	var mode atomic.Value
+	mode.Store("ok")
+	client := &http.Client{Transport: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		if r.URL.Path == "/token" {
+			switch mode.Load() {
+			case "fail":
+				return nil, errors.New("connection refused")
+			case "hang":
+				<-r.Context().Done()
+				return nil, r.Context().Err()
+			}
+		}
+		return http.DefaultTransport.RoundTrip(r)
+	})}
+
+	newAuth := func(t *testing.T, maxStaleness time.Duration) *Authenticator {
+		mode.Store("ok")
+		auth, err := NewAuthenticatorWithConfig(context.Background(), AuthConfig{
+			Host: srv.URL, ClientID: "client", ClientSecret: "secret", HTTPClient: client, MaxStaleness: maxStaleness,
+		})
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = auth.Close(context.Background()) })
+		return auth
+	}
+
+	t.Run("refresh", func(t *testing.T) {
+		auth := newAuth(t, 0)
+		before := auth.tk.Load().AccessToken
+		token, err := auth.TokenContext(context.Background())
+		require.NoError(t, err)
+		require.NotEqual(t, before, token, "expired token is refreshed")
+	})
+
+	t.Run("fail", func(t *testing.T) {
+		auth := newAuth(t, 0)
+		mode.Store("fail")
+		_, err := auth.TokenContext(context.Background())
+		require.ErrorIs(t, err, ErrTokenUnavailable)
+		require.NotEmpty(t, auth.Token(), "Token still falls back to the expired token")
+	})
+
+	t.Run("stale", func(t *testing.T) {
+		auth := newAuth(t, time.Minute)
+		mode.Store("fail")
+		token, err := auth.TokenContext(context.Background())
+		require.NoError(t, err)
+		require.Equal(t, auth.tk.Load().AccessToken, token)
+
+		auth.tk.Store(&jwtToken{AccessToken: "old", ExpireIn: 5, expiresAt: time.Now().Add(-2 * time.Minute)})
+		_, err = auth.TokenContext(context.Background())
+		require.ErrorIs(t, err, ErrTokenUnavailable, "token is staler than MaxStaleness")
+	})
+
+	t.Run("deadline", func(t *testing.T) {
+		auth := newAuth(t, 0)
+		mode.Store("hang")
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		_, err := auth.TokenContext(ctx)
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+
+		require.NoError(t, auth.refreshMu.lock(context.Background()))
+		defer auth.refreshMu.unlock()
+		ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		_, err = auth.TokenContext(ctx)
+		require.ErrorIs(t, err, context.DeadlineExceeded, "waiting for another refresh respects the deadline")
+	})
+}
+
+type verifierFunc func(ctx context.Context, token string, custom any) (*Claims, error)
+
+func (f verifierFunc) VerifyClaims(ctx context.Context, token string, custom any) (*Claims, error) {
+	return f(ctx, token, custom)
+}
+
+func TestGRPC(t *testing.T) {
+	srv := newTestAuthServer(t, nil)
+	// bufconn has no transport security, so plaintext is opted into.
+	auth, err := NewAuthenticatorWithConfig(context.Background(), AuthConfig{
+		Host: srv.URL, ClientID: "client", ClientSecret: "secret", InsecureRPC: true,
+	})
+	require.NoError(t, err)
+
+	// The server only accepts the newest token issued, so the client's first
+	// token is rejected once another one has been issued.
+	var accepted atomic.Value
+	accepted.Store("token-2")
+	verifier := verifierFunc(func(ctx context.Context, token string, _ any) (*Claims, error) {
+		if token == "bound" {
+			return &Claims{Subject: token, Raw: map[string]any{"cnf": map[string]any{"jkt": "x"}}}, nil
+		}
+		if token != accepted.Load() {
+			return nil, ErrTokenExpired
+		}
+		return &Claims{Subject: token}, nil
+	})
+
+	var subjects sync.Map
+	record := func(ctx context.Context, method string) {
+		claims, ok := ClaimsFromContext(ctx)
+		require.True(t, ok)
+		subjects.Store(method, claims.Subject)
+	}
+
+	lis := bufconn.Listen(1 << 20)
+	server := grpc.NewServer(
+		grpc.ChainUnaryInterceptor(UnaryServerInterceptor(verifier), func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+			record(ctx, info.FullMethod)
+			return handler(ctx, req)
+		}),
+		grpc.ChainStreamInterceptor(StreamServerInterceptor(verifier), func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+			record(ss.Context(), info.FullMethod)
+			return handler(srv, ss)
+		}),
+	)
+	grpc_health_v1.RegisterHealthServer(server, health.NewServer())
+	go func() { _ = server.Serve(lis) }()
+	t.Cleanup(server.Stop)
+
+	dial := func(t *testing.T, opts ...grpc.DialOption) grpc_health_v1.HealthClient {
+		conn, err := grpc.NewClient("passthrough:///bufnet", append(opts,
+			grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+			grpc.WithTransportCredentials(insecure.NewCredentials()),
+		)...)
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = conn.Close() })
+		return grpc_health_v1.NewHealthClient(conn)
+	}
+	client := dial(t, grpc.WithUnaryInterceptor(auth.UnaryClientInterceptor()), grpc.WithStreamInterceptor(auth.StreamClientInterceptor()))
+
+	t.Run("unary refreshes on Unauthenticated", func(t *testing.T) {
+		_, err := client.Check(context.Background(), &grpc_health_v1.HealthCheckRequest{})
+		require.NoError(t, err)
+		require.Equal(t, 2, srv.Issued())
+		subject, _ := subjects.Load("/grpc.health.v1.Health/Check")
+		require.Equal(t, "token-2", subject)
+	})
+
+	t.Run("stream refreshes for the next stream", func(t *testing.T) {
+		accepted.Store("token-3")
+
+		stream, err := client.Watch(context.Background(), &grpc_health_v1.HealthCheckRequest{})
+		require.NoError(t, err)
+		_, err = stream.Recv()
+		require.Equal(t, codes.Unauthenticated, status.Code(err))
+		require.Equal(t, 3, srv.Issued())
+
+		stream, err = client.Watch(context.Background(), &grpc_health_v1.HealthCheckRequest{})
+		require.NoError(t, err)
+		_, err = stream.Recv()
+		require.NoError(t, err)
+		subject, _ := subjects.Load("/grpc.health.v1.Health/Watch")
+		require.Equal(t, "token-3", subject)
+	})
+
+	t.Run("server rejects missing and invalid tokens", func(t *testing.T) {
+		plain := dial(t)
+		_, err := plain.Check(context.Background(), &grpc_health_v1.HealthCheckRequest{})
+		require.Equal(t, codes.Unauthenticated, status.Code(err))
+		require.Equal(t, "bearer token is missing", status.Convert(err).Message())
+
+		ctx := metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer token-1")
+		_, err = plain.Check(ctx, &grpc_health_v1.HealthCheckRequest{})
+		require.Equal(t, codes.Unauthenticated, status.Code(err))
+		require.Equal(t, "token is expired", status.Convert(err).Message())
+
+		ctx = metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer bound")
+		_, err = plain.Check(ctx, &grpc_health_v1.HealthCheckRequest{})
+		require.Equal(t, codes.Unauthenticated, status.Code(err))
+		require.Equal(t, "token is bound to a DPoP key", status.Convert(err).Message())
+	})
+
+	t.Run("client requires transport security by default", func(t *testing.T) {
+		secure, err := NewAuthenticatorWithConfig(context.Background(), AuthConfig{
+			Host: srv.URL, ClientID: "client", ClientSecret: "secret",
+		})
+		require.NoError(t, err)
+
+		client := dial(t, grpc.WithUnaryInterceptor(secure.UnaryClientInterceptor()))
+		_, err = client.Check(context.Background(), &grpc_health_v1.HealthCheckRequest{})
+		require.ErrorContains(t, err, "cannot send secure credentials on an insecure connection")
+	})
+
+	t.Run("client refuses DPoP-bound tokens", func(t *testing.T) {
+		bound, err := NewAuthenticatorWithConfig(context.Background(), AuthConfig{
+			Host: srv.URL, ClientID: "client", ClientSecret: "secret", DPoP: true,
+		})
+		require.NoError(t, err)
+		issued := srv.Issued()
+
+		client := dial(t, grpc.WithUnaryInterceptor(bound.UnaryClientInterceptor()), grpc.WithStreamInterceptor(bound.StreamClientInterceptor()))
+		_, err = client.Check(context.Background(), &grpc_health_v1.HealthCheckRequest{})
+		require.Equal(t, codes.Unauthenticated, status.Code(err))
+		require.Equal(t, "DPoP-bound tokens cannot be sent over gRPC", status.Convert(err).Message())
+		_, err = client.Watch(context.Background(), &grpc_health_v1.HealthCheckRequest{})
+		require.Equal(t, codes.Unauthenticated, status.Code(err))
+		require.Equal(t, issued, srv.Issued(), "no refresh is attempted")
+	})
+}
+
+func TestAuthenticator_VerifyCache(t *testing.T) {
+	key := testRSAKey(t)
+	srv := newTestAuthServer(t, map[string]crypto.Signer{"k": key})
+
+	auth, err := NewAuthenticatorWithConfig(context.Background(), AuthConfig{
+		Host: srv.URL, ClientID: "client", ClientSecret: "secret", VerifyCacheSize: 10,
+	})
+	require.NoError(t, err)
+
+	token := srv.Mint(map[string]any{"sub": "42"}, time.Hour)
+	for range 3 {
+		claims, err := auth.VerifyClaims(context.Background(), token, nil)
+		require.NoError(t, err)
+		require.Equal(t, "42", claims.Subject)
+	}
+	require.Equal(t, CacheStats{Hits: 2, Misses: 1, Size: 1}, auth.VerifyCacheStats())
+	_, ok := auth.verified.get(tokenHash(token), time.Now())
+	require.True(t, ok, "tokens are cached by hash")
+
+	_, err = auth.Verify(testSign(t, key, "k", `{"sub":"no exp"}`))
+	require.NoError(t, err)
+	_, err = auth.Verify(testSign(t, testRSAKey(t), "k", `{"sub":"forged","exp":9999999999}`))
+	require.Error(t, err)
+	require.Equal(t, 1, auth.VerifyCacheStats().Size, "tokens without exp and rejected tokens are not cached")
+
+	_, err = auth.jwks.load(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, 1, auth.VerifyCacheStats().Size, "reloading unchanged keys keeps the cache")
+
+	srv.AddKey("new", testRSAKey(t))
+	_, err = auth.jwks.load(context.Background())
+	require.NoError(t, err)
+	require.Zero(t, auth.VerifyCacheStats().Size, "changed keys clear the cache")
+
+	_, err = auth.Verify(token)
+	require.NoError(t, err)
+	require.EqualValues(t, 4, auth.VerifyCacheStats().Misses)
+}
+
+func BenchmarkAuthenticator_Verify(b *testing.B) {
+	srv := servicetest.NewServer(b, servicetest.Options{})
+	token := srv.Mint(map[string]any{"sub": "42"}, time.Hour)
+
+	for name, size := range map[string]int{"uncached": 0, "cached": 1024} {
+		b.Run(name, func(b *testing.B) {
+			auth, err := NewAuthenticatorWithConfig(context.Background(), AuthConfig{
+				Host: srv.URL, ClientID: "client", ClientSecret: "secret", VerifyCacheSize: size,
+			})
+			require.NoError(b, err)
+			b.Cleanup(func() { _ = auth.Close(context.Background()) })
+
+			b.ReportAllocs()
+			for b.Loop() {
+				if _, err := auth.Verify(token); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestAuthenticator_DeviceFlow(t *testing.T) {
+	interval := deviceInterval
+	deviceInterval = 10 * time.Millisecond
+	t.Cleanup(func() { deviceInterval = interval })
+
+	srv := servicetest.NewServer(t, servicetest.Options{Discovery: true, DeviceAuthorization: true})
+	store, err := NewFileTokenStore(t.TempDir())
+	require.NoError(t, err)
+
+	var prompts atomic.Int32
+	var out bytes.Buffer
+	approve := func(ctx context.Context, code DeviceCode) error {
+		prompts.Add(1)
+		if err := PrintDeviceCode(&out)(ctx, code); err != nil {
+			return err
+		}
+		time.AfterFunc(50*time.Millisecond, func() { srv.ApproveDevice(code.UserCode, "alice") })
+		return nil
+	}
+	newAuth := func(prompt func(context.Context, DeviceCode) error) (*Authenticator, error) {
+		return NewAuthenticatorWithConfig(context.Background(), AuthConfig{
+			Host: srv.URL, ClientID: "cli", Scopes: []string{"offline_access"}, TokenStore: store,
+			DeviceAuthorization: prompt,
+		})
+	}
+	subject := func(auth *Authenticator) string {
+		claims, err := auth.VerifyClaims(context.Background(), auth.Token(), nil)
+		require.NoError(t, err)
+		return claims.Subject
+	}
+
+	auth, err := newAuth(approve)
+	require.NoError(t, err)
+	require.Equal(t, "alice", subject(auth))
+	require.EqualValues(t, 1, prompts.Load())
+	require.Contains(t, out.String(), "CODE-0001")
+	require.Greater(t, srv.Requests(servicetest.TokenPath), 1, "the token endpoint is polled until approval")
+	form := srv.LastRequest(servicetest.TokenPath).PostForm
+	require.Equal(t, deviceCodeGrant, form.Get("grant_type"))
+	require.Equal(t, "cli", form.Get("client_id"))
+	require.False(t, form.Has("client_secret"), "a public client sends no secret")
+	require.NoError(t, auth.Close(context.Background()))
+
+	t.Run("stored token", func(t *testing.T) {
+		requests := srv.Requests(servicetest.TokenPath)
+		auth, err := newAuth(approve)
+		require.NoError(t, err)
+		defer auth.Close(context.Background())
+		require.Equal(t, "alice", subject(auth))
+		require.EqualValues(t, 1, prompts.Load())
+		require.Equal(t, requests, srv.Requests(servicetest.TokenPath))
+	})
+
+	t.Run("stored refresh token", func(t *testing.T) {
+		tk := auth.tk.Load()
+		data, err := json.Marshal(storedToken{AccessToken: tk.AccessToken, RefreshToken: tk.RefreshToken, ExpireIn: tk.ExpireIn, ExpiresAt: time.Now().Add(-time.Minute)})
+		require.NoError(t, err)
+		require.NoError(t, store.Save(context.Background(), auth.storeKey, data, time.Hour))
+
+		auth, err := newAuth(approve)
+		require.NoError(t, err)
+		defer auth.Close(context.Background())
+		require.Equal(t, "alice", subject(auth))
+		require.EqualValues(t, 1, prompts.Load())
+		require.Equal(t, "refresh_token", srv.LastRequest(servicetest.TokenPath).PostForm.Get("grant_type"))
+
+		srv.RevokeRefreshTokens()
+		require.ErrorIs(t, auth.refresh(context.Background(), auth.tk.Load()), ErrLoginRequired)
+		require.Equal(t, "refresh_token", srv.LastRequest(servicetest.TokenPath).PostForm.Get("grant_type"), "no client_credentials fallback")
+
+		require.NoError(t, auth.Login(context.Background()))
+		require.EqualValues(t, 2, prompts.Load())
+		require.Equal(t, "alice", subject(auth))
+	})
+
+	t.Run("refresh tokens without rotation", func(t *testing.T) {
+		srv := servicetest.NewServer(t, servicetest.Options{DeviceAuthorization: true, KeepRefreshTokens: true})
+		store, err := NewFileTokenStore(t.TempDir())
+		require.NoError(t, err)
+
+		auth, err := NewAuthenticatorWithConfig(context.Background(), AuthConfig{
+			Host: srv.URL, ClientID: "cli", TokenStore: store,
+			DeviceAuthorization: func(_ context.Context, code DeviceCode) error {
+				time.AfterFunc(50*time.Millisecond, func() { srv.ApproveDevice(code.UserCode, "bob") })
+				return nil
+			},
+		})
+		require.NoError(t, err)
+		defer auth.Close(context.Background())
+		refresh := auth.tk.Load().RefreshToken
+		require.NotEmpty(t, refresh)
+
+		for range 2 {
+			require.NoError(t, auth.refresh(context.Background(), auth.tk.Load()))
+			require.Equal(t, "refresh_token", srv.LastRequest(servicetest.TokenPath).PostForm.Get("grant_type"))
+			require.Equal(t, refresh, auth.tk.Load().RefreshToken, "the refresh token is kept")
+		}
+		require.Equal(t, refresh, auth.loadShared(context.Background()).RefreshToken)
+	})
+
+	t.Run("denied", func(t *testing.T) {
+		srv.FailWithError(servicetest.TokenPath, 1, http.StatusBadRequest, "slow_down")
+		_, err := NewAuthenticatorWithConfig(context.Background(), AuthConfig{
+			Host: srv.URL, ClientID: "cli",
+			DeviceAuthorization: func(_ context.Context, code DeviceCode) error {
+				time.AfterFunc(50*time.Millisecond, func() { srv.DenyDevice(code.UserCode) })
+				return nil
+			},
+		})
+		require.ErrorIs(t, err, ErrDeviceAccessDenied)
+	})
+}
+
+func TestDPoP(t *testing.T) {
+	srv := servicetest.NewServer(t, servicetest.Options{DPoPNonce: "as-nonce"})
+
+	store, err := NewFileTokenStore(t.TempDir())
+	require.NoError(t, err)
+	_, err = NewAuthenticatorWithConfig(context.Background(), AuthConfig{
+		Host: srv.URL, ClientID: "client", ClientSecret: "secret", DPoP: true, TokenStore: store,
+	})
+	require.Error(t, err, "DPoP keys are not shared through a TokenStore")
+
+	auth, err := NewAuthenticatorWithConfig(context.Background(), AuthConfig{Host: srv.URL, ClientID: "client", ClientSecret: "secret", DPoP: true})
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = auth.Close(context.Background()) })
+
+	require.Equal(t, "DPoP", auth.tk.Load().TokenType)
+	require.Equal(t, 2, srv.Requests(servicetest.TokenPath), "the first token request is answered with a nonce")
+	proof, err := josejwt.ParseSigned(srv.LastRequest(servicetest.TokenPath).Header.Get("DPoP"), []jose.SignatureAlgorithm{jose.ES256})
+	require.NoError(t, err)
+	var proofClaims map[string]any
+	require.NoError(t, proof.UnsafeClaimsWithoutVerification(&proofClaims))
+	require.Equal(t, "as-nonce", proofClaims["nonce"])
+
+	claims, err := auth.VerifyClaims(context.Background(), auth.Token(), nil)
+	require.NoError(t, err)
+	require.Equal(t, auth.dpop.jkt, claimAt(claims.Raw, "cnf.jkt"))
+
+	var (
+		mu      sync.Mutex
+		lastReq *http.Request
+		nonced  atomic.Bool
+	)
+	handler := AuthenticateDPoP(auth, DPoPOptions{})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims, _ := ClaimsFromContext(r.Context())
+		_, _ = w.Write([]byte(claims.Subject))
+	}))
+	rs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		lastReq = r.Clone(context.Background())
+		mu.Unlock()
+
+		// The resource server asks for a nonce once.
+		if nonced.CompareAndSwap(false, true) {
+			w.Header().Set("DPoP-Nonce", "rs-nonce")
+			writeChallenge(w, "DPoP", http.StatusUnauthorized, "use_dpop_nonce", "")
+			return
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	t.Cleanup(rs.Close)
+
+	send := func(method, token, proof string) *http.Response {
+		req, err := http.NewRequest(method, rs.URL+"/orders", nil)
+		require.NoError(t, err)
+		req.Header.Set("Authorization", token)
+		if proof != "" {
+			req.Header.Set("DPoP", proof)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		_ = resp.Body.Close()
+		return resp
+	}
+
+	resp, err := auth.Client().Get(rs.URL + "/orders?page=2")
+	require.NoError(t, err)
+	body, _ := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "client", string(body))
+	require.Equal(t, 2, srv.Requests(servicetest.TokenPath), "a nonce challenge does not refresh the token")
+
+	mu.Lock()
+	replayed := lastReq
+	mu.Unlock()
+	require.True(t, strings.HasPrefix(replayed.Header.Get("Authorization"), "DPoP "))
+	proof, err = josejwt.ParseSigned(replayed.Header.Get("DPoP"), []jose.SignatureAlgorithm{jose.ES256})
+	require.NoError(t, err)
+	require.NoError(t, proof.UnsafeClaimsWithoutVerification(&proofClaims))
+	require.Equal(t, "rs-nonce", proofClaims["nonce"], "nonces are tracked per server")
+	require.Equal(t, rs.URL+"/orders", proofClaims["htu"])
+
+	resp = send(http.MethodGet, replayed.Header.Get("Authorization"), replayed.Header.Get("DPoP"))
+	require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	require.Contains(t, resp.Header.Get("WWW-Authenticate"), ErrDPoPProofReplayed.Error())
+
+	token := auth.Token()
+	proofFor := func(method string) string {
+		proof, err := auth.DPoPProof(method, rs.URL+"/orders", token)
+		require.NoError(t, err)
+		return proof
+	}
+
+	resp = send(http.MethodPost, "DPoP "+token, proofFor(http.MethodGet))
+	require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	require.Contains(t, resp.Header.Get("WWW-Authenticate"), "htm does not match")
+
+	other, err := newDPoPKey()
+	require.NoError(t, err)
+	otherProof, err := other.proof(http.MethodGet, rs.URL+"/orders", token)
+	require.NoError(t, err)
+	resp = send(http.MethodGet, "DPoP "+token, otherProof)
+	require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	require.Contains(t, resp.Header.Get("WWW-Authenticate"), ErrDPoPKeyMismatch.Error())
+
+	resp = send(http.MethodGet, "DPoP "+token, "")
+	require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	require.Contains(t, resp.Header.Get("WWW-Authenticate"), `error="invalid_dpop_proof"`)
+
+	resp = send(http.MethodGet, "Bearer "+token, "")
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode, "bearer tokens are not accepted")
+
+	t.Run("bearer", func(t *testing.T) {
+		bearer := AuthenticateDPoP(auth, DPoPOptions{AllowBearer: true})(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+		for _, handler := range []http.Handler{bearer, Authenticate(auth)(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))} {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set("Authorization", "Bearer "+token)
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			require.Equal(t, http.StatusUnauthorized, rec.Code, "a bound token needs its proof")
+			require.Contains(t, rec.Header().Get("WWW-Authenticate"), "bound to a DPoP key")
+		}
+
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Authorization", "Bearer "+srv.Mint(map[string]any{"sub": "42"}, time.Minute))
+		rec := httptest.NewRecorder()
+		bearer.ServeHTTP(rec, req)
+		require.Equal(t, http.StatusOK, rec.Code)
+	})
+
+	t.Run("redis replay cache", func(t *testing.T) {
+		mr := miniredis.RunT(t)
+		ring, err := NewRedis(context.Background(), []string{mr.Addr()}, "")
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = ring.Close() })
+
+		for _, cache := range []ReplayCache{NewMemoryReplayCache(0), NewRedisReplayCache(ring, "dpop:")} {
+			seen, err := cache.Seen(context.Background(), "jti-1", time.Minute)
+			require.NoError(t, err)
+			require.False(t, seen)
+			seen, err = cache.Seen(context.Background(), "jti-1", time.Minute)
+			require.NoError(t, err)
+			require.True(t, seen)
+		}
+	})
+}
+
+func TestMultiVerifier(t *testing.T) {
+	_, err := NewMultiVerifier(context.Background(), MultiVerifierConfig{})
+	require.ErrorIs(t, err, ErrNoIssuers)
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	corp := servicetest.NewServer(t, servicetest.Options{Discovery: true})
+	acquired := servicetest.NewServer(t, servicetest.Options{Keys: map[string]crypto.Signer{"ec-1": ecKey}})
+
+	v, err := NewMultiVerifier(context.Background(), MultiVerifierConfig{Issuers: []IssuerConfig{
+		{Issuer: corp.Issuer(), Audiences: []string{"orders"}},
+		{Issuer: acquired.Issuer(), JWKSURI: acquired.Endpoint(servicetest.JWKSPath), Algorithms: []jose.SignatureAlgorithm{jose.ES256}},
+	}})
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = v.Close() })
+	require.Equal(t, 1, corp.Requests(servicetest.DiscoveryPath), "the JWKS URI is discovered")
+
+	tests := []struct {
+		name  string
+		token string
+		err   error
+	}{
+		{name: "corp", token: corp.Mint(map[string]any{"sub": "1", "aud": "orders"}, time.Minute)},
+		{name: "acquired", token: acquired.Mint(map[string]any{"sub": "2"}, time.Minute)},
+		{name: "audience is per issuer", token: corp.Mint(map[string]any{"aud": "billing"}, time.Minute), err: ErrTokenWrongAudience},
+		{name: "unknown issuer", token: corp.Mint(map[string]any{"iss": "https://evil", "aud": "orders"}, time.Minute), err: ErrTokenWrongIssuer},
+		{name: "algorithm is per issuer", token: acquired.Mint(map[string]any{"iss": corp.Issuer(), "aud": "orders"}, time.Minute), err: ErrKeyAlgorithmMismatch},
+		{name: "keys are per issuer", token: corp.Mint(map[string]any{"iss": acquired.Issuer()}, time.Minute), err: ErrKeyAlgorithmMismatch},
+		{name: "expired", token: acquired.Mint(nil, -time.Hour), err: ErrTokenExpired},
+		{name: "garbage", token: "garbage", err: ErrTokenMalformed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims, err := v.VerifyClaims(context.Background(), tt.token, nil)
+			if tt.err != nil {
+				require.ErrorIs(t, err, tt.err)
+				return
+			}
+			require.NoError(t, err)
+			require.Contains(t, []string{corp.Issuer(), acquired.Issuer()}, claims.Issuer)
+		})
+	}
+
+	_, err = v.VerifyClaims(context.Background(), acquired.Mint(map[string]any{"iss": corp.Issuer()}, time.Minute), nil)
+	require.Equal(t, VerifyReasonAlgorithmMismatch, verifyFailureReason(err), "observers see an algorithm mismatch")
+
+	t.Run("middleware", func(t *testing.T) {
+		handler := Authenticate(v)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			claims, _ := ClaimsFromContext(r.Context())
+			_, _ = w.Write([]byte(claims.Subject))
+		}))
+
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Authorization", "Bearer "+acquired.Mint(map[string]any{"sub": "2"}, time.Minute))
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		require.Equal(t, http.StatusOK, rec.Code)
+		require.Equal(t, "2", rec.Body.String())
+	})
+}
+
+func TestSigner(t *testing.T) {
+	srv := newTestAuthServer(t, nil)
+
+	signer, err := NewSigner(context.Background(), SignerConfig{Issuer: "https://workers", RotationInterval: time.Hour})
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = signer.Close() })
+
+	jwksSrv := httptest.NewServer(signer.JWKSHandler())
+	t.Cleanup(jwksSrv.Close)
+
+	auth, err := NewAuthenticatorWithConfig(context.Background(), AuthConfig{
+		TokenEndpoint: srv.URL + "/token", JWKSURI: jwksSrv.URL, ClientID: "client", ClientSecret: "secret",
+		Issuers: []string{"https://workers"}, Audiences: []string{"callbacks"},
+	})
+	require.NoError(t, err)
+	require.Len(t, auth.jwks.current().Keys, 2, "the next key is published ahead of use")
+
+	resp, err := http.Get(jwksSrv.URL)
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	require.Equal(t, "public, max-age=300", resp.Header.Get("Cache-Control"))
+
+	sign := func() string {
+		token, err := signer.Sign(Claims{Subject: "job-1", Audience: josejwt.Audience{"callbacks"}}, map[string]any{"job": "resize"})
+		require.NoError(t, err)
+		return token
+	}
+	verify := func(token string) error {
+		var custom struct {
+			Job string `json:"job"`
+		}
+		claims, err := auth.VerifyClaims(context.Background(), token, &custom)
+		if err == nil {
+			require.Equal(t, "job-1", claims.Subject)
+			require.NotEmpty(t, claims.ID)
+			require.Equal(t, "resize", custom.Job)
+		}
+		return err
+	}
+
+	old := sign()
+	require.NoError(t, verify(old))
+
+	oldKID := signer.KeyID()
+	require.NoError(t, signer.Rotate())
+	require.NotEqual(t, oldKID, signer.KeyID())
+	require.NoError(t, verify(sign()), "the new key was already published")
+	require.NoError(t, verify(old), "the retired key is kept for the grace period")
+
+	signer.mu.Lock()
+	signer.retired[0].retiredAt = time.Now().Add(-time.Hour)
+	signer.mu.Unlock()
+	require.Len(t, signer.JWKS().Keys, 2, "keys past the grace period are dropped")
+
+	t.Run("key", func(t *testing.T) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		require.NoError(t, err)
+		signer, err := NewSigner(context.Background(), SignerConfig{Key: key, KeyID: "ec-1"})
+		require.NoError(t, err)
+
+		token, err := signer.Sign(Claims{Subject: "1"}, nil)
+		require.NoError(t, err)
+		jws, err := jose.ParseSigned(token, []jose.SignatureAlgorithm{jose.ES256})
+		require.NoError(t, err)
+		require.Equal(t, "ec-1", jws.Signatures[0].Header.KeyID)
+		require.Len(t, signer.JWKS().Keys, 1)
+
+		require.NoError(t, signer.Close())
+		_, err = signer.Sign(Claims{}, nil)
+		require.ErrorIs(t, err, ErrSignerClosed)
+	})
+}
+
+type recordingObserver struct {
+	mu     sync.Mutex
+	events []string
+}
+
+func (o *recordingObserver) record(event string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.events = append(o.events, event)
+}
+
+func (o *recordingObserver) take() []string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	events := o.events
+	o.events = nil
+	return events
+}
+
+func (o *recordingObserver) OnGrant(e GrantEvent) {
+	o.record(fmt.Sprintf("grant %s %v", e.GrantType, e.Err != nil))
+}
+func (o *recordingObserver) OnFallback(FallbackEvent) { o.record("fallback") }
+func (o *recordingObserver) OnJWKSReload(e JWKSReloadEvent) {
+	o.record(fmt.Sprintf("jwks %d %v", e.Keys, e.Err != nil))
+}
+func (o *recordingObserver) OnVerifyFailure(e VerifyFailureEvent) { o.record("verify " + e.Reason) }
+
+func TestAuthenticator_Observer(t *testing.T) {
+	key := testRSAKey(t)
+	srv := newTestAuthServer(t, map[string]crypto.Signer{"k": key})
+
+	observer := &recordingObserver{}
+	auth, err := NewAuthenticatorWithConfig(context.Background(), AuthConfig{
+		Host: srv.URL, ClientID: "client", ClientSecret: "secret", Observer: observer,
+	})
+	require.NoError(t, err)
+	require.Equal(t, []string{"jwks 1 false", "grant client_credentials false"}, observer.take())
+
+	srv.RevokeRefreshTokens()
+	require.True(t, auth.Refresh(context.Background()))
+	require.Equal(t, []string{"grant refresh_token true", "fallback", "grant client_credentials false"}, observer.take())
+
+	_, err = auth.Verify("garbage")
+	require.ErrorIs(t, err, ErrTokenMalformed)
+	_, err = auth.Verify(testSign(t, testRSAKey(t), "k", `{"sub":"1"}`))
+	require.Error(t, err)
+	_, err = auth.VerifyClaims(context.Background(), testSign(t, key, "k", `{"exp":1}`), nil)
+	require.ErrorIs(t, err, ErrTokenExpired)
+	_, err = auth.VerifyClaims(context.Background(), testSign(t, key, "k", `{"sub":"1"}`), nil)
+	require.NoError(t, err)
+	require.Equal(t, []string{"verify malformed", "verify invalid_signature", "verify expired"}, observer.take())
+
+	t.Run("expvar", func(t *testing.T) {
+		o := NewExpvarObserver("test_auth")
+		o.OnGrant(GrantEvent{GrantType: "client_credentials", Duration: 20 * time.Millisecond})
+		o.OnGrant(GrantEvent{GrantType: "client_credentials", Duration: 2 * time.Second, Err: errors.New("boom")})
+		o.OnFallback(FallbackEvent{})
+		o.OnJWKSReload(JWKSReloadEvent{Duration: time.Millisecond, Keys: 2})
+		o.OnVerifyFailure(VerifyFailureEvent{Reason: VerifyReasonExpired})
+		o.OnVerifyFailure(VerifyFailureEvent{Reason: VerifyReasonExpired})
+
+		var vars struct {
+			Grants       map[string]int `json:"grants"`
+			GrantErrors  map[string]int `json:"grant_errors"`
+			GrantSeconds map[string]struct {
+				Count   int            `json:"count"`
+				Buckets map[string]int `json:"buckets"`
+			} `json:"grant_seconds"`
+			Fallbacks      int            `json:"fallbacks"`
+			JWKSReloads    int            `json:"jwks_reloads"`
+			VerifyFailures map[string]int `json:"verify_failures"`
+		}
+		require.NoError(t, json.Unmarshal([]byte(expvar.Get("test_auth").String()), &vars))
+		require.Equal(t, 2, vars.Grants["client_credentials"])
+		require.Equal(t, 1, vars.GrantErrors["client_credentials"])
+		require.Equal(t, 2, vars.GrantSeconds["client_credentials"].Count)
+		require.Equal(t, 1, vars.GrantSeconds["client_credentials"].Buckets["0.025"])
+		require.Equal(t, 2, vars.GrantSeconds["client_credentials"].Buckets["+Inf"])
+		require.Equal(t, 1, vars.Fallbacks)
+		require.Equal(t, 1, vars.JWKSReloads)
+		require.Equal(t, 2, vars.VerifyFailures[VerifyReasonExpired])
+	})
+}
+
+func TestTTLCache(t *testing.T) {
+	now := time.Now()
+	c := newTTLCache[int](2)
+
+	c.set("a", 1, now.Add(time.Minute))
+	c.set("b", 2, now.Add(time.Minute))
+	_, ok := c.get("a", now)
+	require.True(t, ok)
+
+	c.set("c", 3, now.Add(time.Minute))
+	_, ok = c.get("b", now)
+	require.False(t, ok, "least recently used entry is evicted")
+	v, ok := c.get("a", now)
+	require.True(t, ok)
+	require.Equal(t, 1, v)
+
+	_, ok = c.get("c", now.Add(time.Minute))
+	require.False(t, ok, "expired entry")
+	require.Equal(t, 1, c.len())
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(r *http.Request) (*http.Response, error) { return f(r) }
+
+func TestCacheMaxAge(t *testing.T) {
+	require.Equal(t, 10*time.Minute, cacheMaxAge("public, max-age=600"))
+	require.Equal(t, jwksMinRefreshInterval, cacheMaxAge("max-age=0"))
+	require.Equal(t, jwksMaxRefreshInterval, cacheMaxAge("max-age=9999999"))
+	require.Equal(t, jwksDefaultRefreshInterval, cacheMaxAge("no-cache"))
+	require.Equal(t, jwksDefaultRefreshInterval, cacheMaxAge("max-age=abc"))
+}
+
+func testRSAKey(t *testing.T) *rsa.PrivateKey {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	return key
+}
+
+func testSign(t *testing.T, key *rsa.PrivateKey, kid, payload string) string {
+	return testSignWith(t, jose.RS256, key, kid, payload)
+}
+
+func testSignWith(t *testing.T, alg jose.SignatureAlgorithm, key crypto.Signer, kid, payload string) string {
+	opts := &jose.SignerOptions{}
+	if kid != "" {
+		opts.WithHeader("kid", kid)
+	}
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: alg, Key: key}, opts)
+	require.NoError(t, err)
+	jws, err := signer.Sign([]byte(payload))
+	require.NoError(t, err)
+	token, err := jws.CompactSerialize()
+	require.NoError(t, err)
+	return token
+}
+
+// newTestAuthServer starts a fake auth service publishing the given keys and
+// issuing numbered opaque tokens, and points the AUTH_* environment at it.
+func newTestAuthServer(t *testing.T, keys map[string]crypto.Signer) *servicetest.Server {
+	srv := servicetest.NewServer(t, servicetest.Options{Keys: keys, OpaqueTokens: true, Introspection: true})
+
+	t.Setenv("AUTH_HOST", srv.URL)
+	t.Setenv("AUTH_CLIENT_ID", "client")
+	t.Setenv("AUTH_CLIENT_SECRET", "secret")
+
+	return srv
+}
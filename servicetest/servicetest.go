@@ -0,0 +1,781 @@
+// Package servicetest provides an in-process OAuth2 authorization server for
+// testing code built on the service package's Authenticator without a real auth
+// service. The Server issues tokens at its token endpoint, publishes its signing
+// keys as a JWKS, optionally serves OpenID Connect discovery, RFC 7662
+// introspection, the RFC 8628 device authorization grant and RFC 9449 DPoP, mints
+// tokens with chosen claims and lifetimes, and can inject failures such as error
+// responses, latency, revoked refresh tokens and key rotation.
+package servicetest
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+)
+
+// Paths of the endpoints served below the Server's base URL.
+const (
+	TokenPath         = "/token"
+	JWKSPath          = "/.well-known/jwks.json"
+	DiscoveryPath     = "/.well-known/openid-configuration"
+	IntrospectionPath = "/introspect"
+	RevocationPath    = "/revoke"
+
+	DeviceAuthorizationPath = "/device"
+)
+
+const (
+	tokenExchangeGrant = "urn:ietf:params:oauth:grant-type:token-exchange"
+	deviceCodeGrant    = "urn:ietf:params:oauth:grant-type:device_code"
+
+	defaultTokenTTL   = time.Hour
+	defaultJWKSMaxAge = 10 * time.Minute
+	defaultDeviceTTL  = 10 * time.Minute
+)
+
+// Options configures a Server. The zero value serves the token, JWKS and
+// revocation endpoints with a generated RSA key and accepts any client.
+type Options struct {
+	// ClientID and ClientSecret, when set, are required from clients of the token,
+	// introspection and revocation endpoints, sent either as HTTP Basic
+	// credentials or as form parameters. A private_key_jwt client_assertion is
+	// accepted for ClientID without checking its signature.
+	ClientID     string
+	ClientSecret string
+
+	// Keys are the signing keys published in the JWKS, by kid. When empty a 2048
+	// bit RSA key is generated. SigningKeyID selects the key used to sign tokens;
+	// the lowest kid by default.
+	Keys         map[string]crypto.Signer
+	SigningKeyID string
+
+	// TokenTTL is the lifetime of issued tokens; one hour by default.
+	TokenTTL time.Duration
+	// Claims are added to every access token issued by the token endpoint.
+	Claims map[string]any
+	// OpaqueTokens makes the token endpoint issue sequential opaque access tokens,
+	// token-1, token-2 and so on, which can only be checked through introspection,
+	// instead of JWTs.
+	OpaqueTokens bool
+
+	// BasePath is prepended to every endpoint path, e.g. /realms/test to mimic a
+	// Keycloak realm. Issuer returns the URL including it.
+	BasePath string
+	// Discovery serves BasePath/.well-known/openid-configuration.
+	Discovery bool
+	// Introspection serves the RFC 7662 introspection endpoint.
+	Introspection bool
+	// JWKSMaxAge is sent as the JWKS Cache-Control max-age; ten minutes by default.
+	JWKSMaxAge time.Duration
+	// DeviceAuthorization serves the RFC 8628 device authorization endpoint and
+	// grant. Requests stay pending until ApproveDevice or DenyDevice is called, or
+	// DeviceCodeTTL (ten minutes by default) passes.
+	DeviceAuthorization bool
+	DeviceCodeTTL       time.Duration
+	// DPoPNonce, when set, must be in the DPoP proofs sent to the token endpoint.
+	// Proofs without it are answered with use_dpop_nonce and the nonce in the
+	// DPoP-Nonce header. Tokens requested with a valid proof are always bound to
+	// its key through cnf.jkt and issued with the DPoP token type.
+	DPoPNonce string
+	// KeepRefreshTokens answers refresh_token grants without a new refresh token,
+	// like servers that do not rotate them (RFC 6749, section 6), so clients keep
+	// using the one they have.
+	KeepRefreshTokens bool
+}
+
+// Server is a fake OAuth2 authorization server backed by an httptest.Server. All
+// of its methods are safe for concurrent use, also while requests are served.
+type Server struct {
+	*httptest.Server
+
+	opts Options
+
+	mu          sync.Mutex
+	keys        map[string]crypto.Signer
+	signingKID  string
+	rotations   int
+	ttl         time.Duration
+	latency     time.Duration
+	failures    map[string][]failure
+	requests    map[string]int
+	last        map[string]*http.Request
+	issued      int
+	opaque      int
+	deviceCodes int
+	tokens      map[string]*issuedToken
+	revoked     []string
+	devices     map[string]*deviceRequest
+}
+
+// failure is an error response queued by Fail or FailWithError.
+type failure struct {
+	status int
+	code   string
+}
+
+// deviceRequest is a pending device authorization request.
+type deviceRequest struct {
+	userCode  string
+	scope     string
+	expiresAt time.Time
+	subject   string
+	denied    bool
+}
+
+// issuedToken is what the Server remembers about a token it issued.
+type issuedToken struct {
+	claims    map[string]any
+	expiresAt time.Time
+	refresh   bool
+	revoked   bool
+}
+
+// NewServer starts a Server configured by opts. It is closed when tb's test ends.
+func NewServer(tb testing.TB, opts Options) *Server {
+	tb.Helper()
+
+	s := &Server{
+		opts:     opts,
+		keys:     maps.Clone(opts.Keys),
+		ttl:      opts.TokenTTL,
+		failures: map[string][]failure{},
+		requests: map[string]int{},
+		last:     map[string]*http.Request{},
+		tokens:   map[string]*issuedToken{},
+		devices:  map[string]*deviceRequest{},
+	}
+	if s.ttl <= 0 {
+		s.ttl = defaultTokenTTL
+	}
+	if s.opts.JWKSMaxAge <= 0 {
+		s.opts.JWKSMaxAge = defaultJWKSMaxAge
+	}
+	if s.opts.DeviceCodeTTL <= 0 {
+		s.opts.DeviceCodeTTL = defaultDeviceTTL
+	}
+
+	if len(s.keys) == 0 {
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			tb.Fatalf("failed to generate signing key: %v", err)
+		}
+		s.keys = map[string]crypto.Signer{"key-0": key}
+	}
+	s.signingKID = opts.SigningKeyID
+	if _, ok := s.keys[s.signingKID]; !ok {
+		s.signingKID = slices.Min(slices.Collect(maps.Keys(s.keys)))
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(opts.BasePath+TokenPath, s.handleToken)
+	mux.HandleFunc(opts.BasePath+JWKSPath, s.handleJWKS)
+	mux.HandleFunc(opts.BasePath+RevocationPath, s.handleRevoke)
+	if opts.Discovery {
+		mux.HandleFunc(opts.BasePath+DiscoveryPath, s.handleDiscovery)
+	}
+	if opts.Introspection {
+		mux.HandleFunc(opts.BasePath+IntrospectionPath, s.handleIntrospect)
+	}
+	if opts.DeviceAuthorization {
+		mux.HandleFunc(opts.BasePath+DeviceAuthorizationPath, s.handleDevice)
+	}
+
+	s.Server = httptest.NewServer(s.intercept(mux))
+	tb.Cleanup(s.Close)
+
+	return s
+}
+
+// Issuer returns the Server's issuer, its URL followed by BasePath. It is the iss
+// of minted tokens and the URL to use as the Authenticator's Host.
+func (s *Server) Issuer() string {
+	return s.URL + s.opts.BasePath
+}
+
+// Endpoint returns the URL of the endpoint at path, e.g. TokenPath.
+func (s *Server) Endpoint(path string) string {
+	return s.Issuer() + path
+}
+
+// Mint returns a JWT signed with the current signing key carrying claims, with
+// iss, iat and exp (ttl from now) set unless claims has them. A negative ttl
+// mints an already expired token.
+func (s *Server) Mint(claims map[string]any, ttl time.Duration) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.mint(claims, ttl)
+}
+
+// MintOpaque returns an opaque token, opaque-1, opaque-2 and so on, that the
+// introspection endpoint reports as active with claims until ttl from now.
+func (s *Server) MintOpaque(claims map[string]any, ttl time.Duration) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.opaque++
+	token := "opaque-" + strconv.Itoa(s.opaque)
+	s.tokens[token] = &issuedToken{claims: s.withDefaults(claims, ttl), expiresAt: time.Now().Add(ttl)}
+
+	return token
+}
+
+// AddKey publishes key in the JWKS under kid without signing with it.
+func (s *Server) AddKey(kid string, key crypto.Signer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.keys[kid] = key
+}
+
+// RemoveKey stops publishing the key with kid. Removing the signing key makes the
+// lowest remaining kid sign.
+func (s *Server) RemoveKey(kid string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.keys, kid)
+	if kid == s.signingKID && len(s.keys) > 0 {
+		s.signingKID = slices.Min(slices.Collect(maps.Keys(s.keys)))
+	}
+}
+
+// RotateKey generates a new RSA key, publishes it next to the existing ones and
+// signs with it from now on. It returns the new key's kid. Call RemoveKey with
+// the old kid to finish the rotation.
+func (s *Server) RotateKey() string {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic(fmt.Sprintf("servicetest: failed to generate signing key: %v", err))
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.rotations++
+	kid := "key-" + strconv.Itoa(s.rotations)
+	s.keys[kid] = key
+	s.signingKID = kid
+
+	return kid
+}
+
+// SigningKeyID returns the kid of the key tokens are currently signed with.
+func (s *Server) SigningKeyID() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.signingKID
+}
+
+// SetTokenTTL changes the lifetime of tokens issued from now on.
+func (s *Server) SetTokenTTL(ttl time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.ttl = ttl
+}
+
+// SetLatency delays every response by d.
+func (s *Server) SetLatency(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.latency = d
+}
+
+// Fail makes the next n requests to the endpoint at path, e.g. TokenPath, fail
+// with status. Failures queue up behind those not yet served.
+func (s *Server) Fail(path string, n, status int) {
+	s.FailWithError(path, n, status, "server_error")
+}
+
+// FailWithError is Fail with the OAuth error code to answer with, e.g. slow_down.
+func (s *Server) FailWithError(path string, n, status int, code string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for range n {
+		s.failures[path] = append(s.failures[path], failure{status: status, code: code})
+	}
+}
+
+// ApproveDevice approves the pending device authorization request with userCode
+// for subject, as the user would in their browser. It reports whether such a
+// request was pending.
+func (s *Server) ApproveDevice(userCode, subject string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, req := range s.devices {
+		if req.userCode == userCode {
+			req.subject = subject
+			return true
+		}
+	}
+	return false
+}
+
+// DenyDevice denies the pending device authorization request with userCode. It
+// reports whether such a request was pending.
+func (s *Server) DenyDevice(userCode string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, req := range s.devices {
+		if req.userCode == userCode {
+			req.denied = true
+			return true
+		}
+	}
+	return false
+}
+
+// RevokeRefreshTokens revokes every refresh token issued so far, so the next
+// refresh_token grant fails with invalid_grant.
+func (s *Server) RevokeRefreshTokens() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, tk := range s.tokens {
+		if tk.refresh {
+			tk.revoked = true
+		}
+	}
+}
+
+// Revoke revokes an issued access or refresh token, as the revocation endpoint
+// does.
+func (s *Server) Revoke(token string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if tk, ok := s.tokens[token]; ok {
+		tk.revoked = true
+	}
+}
+
+// Requests returns the number of requests made to the endpoint at path, e.g.
+// TokenPath, including failed ones.
+func (s *Server) Requests(path string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.requests[path]
+}
+
+// LastRequest returns the last request made to the endpoint at path, with its
+// form parsed, or nil if there was none.
+func (s *Server) LastRequest(path string) *http.Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.last[path]
+}
+
+// Issued returns the number of access tokens issued by the token endpoint.
+func (s *Server) Issued() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.issued
+}
+
+// Revoked returns the revocation requests received, as token_type_hint:token.
+func (s *Server) Revoked() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return slices.Clone(s.revoked)
+}
+
+// intercept records requests and applies the configured latency and failures
+// before handing over to next.
+func (s *Server) intercept(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = r.ParseForm()
+		path := strings.TrimPrefix(r.URL.Path, s.opts.BasePath)
+
+		s.mu.Lock()
+		s.requests[path]++
+		s.last[path] = r.Clone(r.Context())
+		latency := s.latency
+		var fail failure
+		if queued := s.failures[path]; len(queued) > 0 {
+			fail, s.failures[path] = queued[0], queued[1:]
+		}
+		s.mu.Unlock()
+
+		if latency > 0 {
+			select {
+			case <-time.After(latency):
+			case <-r.Context().Done():
+				return
+			}
+		}
+
+		if fail.status != 0 {
+			writeError(w, fail.status, fail.code)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) handleToken(w http.ResponseWriter, r *http.Request) {
+	clientID, ok := s.authenticate(r)
+	if !ok {
+		writeError(w, http.StatusUnauthorized, "invalid_client")
+		return
+	}
+
+	var jkt string
+	if proof := r.Header.Get("DPoP"); proof != "" {
+		var nonce string
+		var err error
+		if jkt, nonce, err = s.checkProof(r, proof); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid_dpop_proof")
+			return
+		}
+		if s.opts.DPoPNonce != "" && nonce != s.opts.DPoPNonce {
+			w.Header().Set("DPoP-Nonce", s.opts.DPoPNonce)
+			writeError(w, http.StatusBadRequest, "use_dpop_nonce")
+			return
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	claims := map[string]any{"sub": clientID, "client_id": clientID}
+	grantType := r.PostForm.Get("grant_type")
+	switch grantType {
+	case "client_credentials":
+	case "refresh_token":
+		tk, ok := s.tokens[r.PostForm.Get("refresh_token")]
+		if !ok || !tk.refresh || tk.revoked {
+			writeError(w, http.StatusBadRequest, "invalid_grant")
+			return
+		}
+		claims = tk.claims
+	case deviceCodeGrant:
+		code := r.PostForm.Get("device_code")
+		req, ok := s.devices[code]
+		switch {
+		case !ok:
+			writeError(w, http.StatusBadRequest, "invalid_grant")
+			return
+		case time.Now().After(req.expiresAt):
+			writeError(w, http.StatusBadRequest, "expired_token")
+			return
+		case req.denied:
+			writeError(w, http.StatusBadRequest, "access_denied")
+			return
+		case req.subject == "":
+			writeError(w, http.StatusBadRequest, "authorization_pending")
+			return
+		}
+		delete(s.devices, code)
+		claims = map[string]any{"sub": req.subject, "client_id": clientID}
+		if req.scope != "" {
+			claims["scope"] = req.scope
+		}
+	case tokenExchangeGrant:
+		if r.PostForm.Get("subject_token") == "" {
+			writeError(w, http.StatusBadRequest, "invalid_request")
+			return
+		}
+	default:
+		writeError(w, http.StatusBadRequest, "unsupported_grant_type")
+		return
+	}
+
+	claims = maps.Clone(claims)
+	if scope := r.PostForm.Get("scope"); scope != "" {
+		claims["scope"] = scope
+	}
+	if audience := r.PostForm.Get("audience"); audience != "" {
+		claims["aud"] = audience
+	}
+	maps.Copy(claims, s.opts.Claims)
+	tokenType := "Bearer"
+	if jkt != "" {
+		claims["cnf"] = map[string]any{"jkt": jkt}
+		tokenType = "DPoP"
+	}
+
+	s.issued++
+	n := strconv.Itoa(s.issued)
+
+	var access string
+	if s.opts.OpaqueTokens {
+		access = "token-" + n
+	} else {
+		access = s.mint(claims, s.ttl)
+	}
+	expiresAt := time.Now().Add(s.ttl)
+	s.tokens[access] = &issuedToken{claims: s.withDefaults(claims, s.ttl), expiresAt: expiresAt}
+
+	resp := map[string]any{
+		"access_token": access,
+		"token_type":   tokenType,
+		"expires_in":   int(s.ttl / time.Second),
+	}
+	if !s.opts.KeepRefreshTokens || grantType != "refresh_token" {
+		refresh := "refresh-" + n
+		s.tokens[refresh] = &issuedToken{claims: claims, refresh: true}
+		resp["refresh_token"] = refresh
+	}
+
+	writeJSON(w, resp)
+}
+
+func (s *Server) handleJWKS(w http.ResponseWriter, _ *http.Request) {
+	s.mu.Lock()
+	jwks := jose.JSONWebKeySet{}
+	for _, kid := range slices.Sorted(maps.Keys(s.keys)) {
+		key := s.keys[kid]
+		jwks.Keys = append(jwks.Keys, jose.JSONWebKey{Key: key.Public(), KeyID: kid, Use: "sig"})
+	}
+	s.mu.Unlock()
+
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(s.opts.JWKSMaxAge/time.Second)))
+	writeJSON(w, jwks)
+}
+
+func (s *Server) handleDiscovery(w http.ResponseWriter, _ *http.Request) {
+	metadata := map[string]any{
+		"issuer":              s.Issuer(),
+		"token_endpoint":      s.Endpoint(TokenPath),
+		"jwks_uri":            s.Endpoint(JWKSPath),
+		"revocation_endpoint": s.Endpoint(RevocationPath),
+	}
+	if s.opts.Introspection {
+		metadata["introspection_endpoint"] = s.Endpoint(IntrospectionPath)
+	}
+	if s.opts.DeviceAuthorization {
+		metadata["device_authorization_endpoint"] = s.Endpoint(DeviceAuthorizationPath)
+	}
+	writeJSON(w, metadata)
+}
+
+func (s *Server) handleDevice(w http.ResponseWriter, r *http.Request) {
+	if _, ok := s.authenticate(r); !ok {
+		writeError(w, http.StatusUnauthorized, "invalid_client")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.deviceCodes++
+	code := "device-" + strconv.Itoa(s.deviceCodes)
+	userCode := fmt.Sprintf("CODE-%04d", s.deviceCodes)
+
+	s.devices[code] = &deviceRequest{
+		userCode:  userCode,
+		scope:     r.PostForm.Get("scope"),
+		expiresAt: time.Now().Add(s.opts.DeviceCodeTTL),
+	}
+
+	writeJSON(w, map[string]any{
+		"device_code":               code,
+		"user_code":                 userCode,
+		"verification_uri":          s.Endpoint("/activate"),
+		"verification_uri_complete": s.Endpoint("/activate?user_code=" + userCode),
+		"expires_in":                int(s.opts.DeviceCodeTTL / time.Second),
+	})
+}
+
+func (s *Server) handleIntrospect(w http.ResponseWriter, r *http.Request) {
+	if _, ok := s.authenticate(r); !ok {
+		writeError(w, http.StatusUnauthorized, "invalid_client")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tk, ok := s.tokens[r.PostForm.Get("token")]
+	if !ok || tk.refresh || tk.revoked || time.Now().After(tk.expiresAt) {
+		writeJSON(w, map[string]any{"active": false})
+		return
+	}
+
+	resp := maps.Clone(tk.claims)
+	resp["active"] = true
+	writeJSON(w, resp)
+}
+
+func (s *Server) handleRevoke(w http.ResponseWriter, r *http.Request) {
+	if _, ok := s.authenticate(r); !ok {
+		writeError(w, http.StatusUnauthorized, "invalid_client")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	token := r.PostForm.Get("token")
+	s.revoked = append(s.revoked, r.PostForm.Get("token_type_hint")+":"+token)
+	if tk, ok := s.tokens[token]; ok {
+		tk.revoked = true
+	}
+}
+
+// checkProof verifies a DPoP proof sent to the token endpoint and returns the
+// thumbprint of its key and its nonce.
+func (s *Server) checkProof(r *http.Request, proof string) (jkt, nonce string, err error) {
+	jws, err := jose.ParseSigned(proof, []jose.SignatureAlgorithm{jose.ES256, jose.ES384, jose.ES512, jose.EdDSA, jose.RS256, jose.PS256})
+	if err != nil {
+		return "", "", err
+	}
+
+	header := jws.Signatures[0].Header
+	if typ, _ := header.ExtraHeaders[jose.HeaderType].(string); typ != "dpop+jwt" || header.JSONWebKey == nil {
+		return "", "", errors.New("not a DPoP proof")
+	}
+
+	payload, err := jws.Verify(header.JSONWebKey)
+	if err != nil {
+		return "", "", err
+	}
+
+	var claims struct {
+		Method string `json:"htm"`
+		URI    string `json:"htu"`
+		Nonce  string `json:"nonce"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return "", "", err
+	}
+	if claims.Method != r.Method || claims.URI != s.Endpoint(TokenPath) {
+		return "", "", fmt.Errorf("proof is for %s %s", claims.Method, claims.URI)
+	}
+
+	thumbprint, err := header.JSONWebKey.Thumbprint(crypto.SHA256)
+	if err != nil {
+		return "", "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(thumbprint), claims.Nonce, nil
+}
+
+// authenticate returns the client_id of r's client and whether it matches the
+// configured client.
+func (s *Server) authenticate(r *http.Request) (string, bool) {
+	clientID, secret, basic := r.BasicAuth()
+	if basic {
+		clientID, _ = url.QueryUnescape(clientID)
+		secret, _ = url.QueryUnescape(secret)
+	} else {
+		clientID, secret = r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+	}
+
+	assertion := r.PostForm.Get("client_assertion")
+	if assertion != "" {
+		var claims jwt.Claims
+		tk, err := jwt.ParseSigned(assertion, []jose.SignatureAlgorithm{
+			jose.RS256, jose.RS384, jose.RS512, jose.PS256, jose.PS384, jose.PS512,
+			jose.ES256, jose.ES384, jose.ES512, jose.EdDSA,
+		})
+		if err != nil || tk.UnsafeClaimsWithoutVerification(&claims) != nil {
+			return "", false
+		}
+		clientID = claims.Issuer
+	}
+
+	if s.opts.ClientID == "" {
+		return clientID, true
+	}
+	if clientID != s.opts.ClientID {
+		return clientID, false
+	}
+	return clientID, assertion != "" || s.opts.ClientSecret == "" || secret == s.opts.ClientSecret
+}
+
+// mint must be called with mu held.
+func (s *Server) mint(claims map[string]any, ttl time.Duration) string {
+	key := s.keys[s.signingKID]
+
+	signer, err := jose.NewSigner(
+		jose.SigningKey{Algorithm: algorithm(key), Key: key},
+		(&jose.SignerOptions{}).WithType("JWT").WithHeader("kid", s.signingKID),
+	)
+	if err != nil {
+		panic(fmt.Sprintf("servicetest: failed to create signer: %v", err))
+	}
+
+	token, err := jwt.Signed(signer).Claims(s.withDefaults(claims, ttl)).Serialize()
+	if err != nil {
+		panic(fmt.Sprintf("servicetest: failed to sign token: %v", err))
+	}
+
+	return token
+}
+
+// withDefaults returns claims with iss, iat and exp added unless already set.
+func (s *Server) withDefaults(claims map[string]any, ttl time.Duration) map[string]any {
+	now := time.Now()
+
+	out := map[string]any{
+		"iss": s.Issuer(),
+		"iat": now.Unix(),
+		"exp": now.Add(ttl).Unix(),
+	}
+	maps.Copy(out, claims)
+
+	return out
+}
+
+// algorithm returns the JWS algorithm used with key.
+func algorithm(key crypto.Signer) jose.SignatureAlgorithm {
+	switch k := key.Public().(type) {
+	case *rsa.PublicKey:
+		return jose.RS256
+	case *ecdsa.PublicKey:
+		switch k.Curve {
+		case elliptic.P384():
+			return jose.ES384
+		case elliptic.P521():
+			return jose.ES512
+		}
+		return jose.ES256
+	case ed25519.PublicKey:
+		return jose.EdDSA
+	}
+	return ""
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// writeError answers with an RFC 6749 error response.
+func writeError(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(map[string]string{"error": code})
+}
@@ -0,0 +1,217 @@
+package servicetest
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+	"github.com/stretchr/testify/require"
+)
+
+func postForm(t *testing.T, uri string, data url.Values) (int, map[string]any) {
+	t.Helper()
+
+	resp, err := http.PostForm(uri, data)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	var body map[string]any
+	_ = json.NewDecoder(resp.Body).Decode(&body)
+	return resp.StatusCode, body
+}
+
+func fetchJWKS(t *testing.T, s *Server) jose.JSONWebKeySet {
+	t.Helper()
+
+	resp, err := http.Get(s.Endpoint(JWKSPath))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, "public, max-age=600", resp.Header.Get("Cache-Control"))
+
+	var jwks jose.JSONWebKeySet
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&jwks))
+	return jwks
+}
+
+func verify(t *testing.T, s *Server, token string) map[string]any {
+	t.Helper()
+
+	tk, err := jwt.ParseSigned(token, []jose.SignatureAlgorithm{jose.RS256})
+	require.NoError(t, err)
+	jwks := fetchJWKS(t, s)
+	keys := jwks.Key(tk.Headers[0].KeyID)
+	require.Len(t, keys, 1)
+
+	var claims map[string]any
+	require.NoError(t, tk.Claims(keys[0].Key, &claims))
+	return claims
+}
+
+func TestServer_Token(t *testing.T) {
+	s := NewServer(t, Options{ClientID: "client", ClientSecret: "secret", Claims: map[string]any{"tenant": "acme"}})
+	client := url.Values{"client_id": {"client"}, "client_secret": {"secret"}}
+
+	status, body := postForm(t, s.Endpoint(TokenPath), url.Values{
+		"grant_type": {"client_credentials"}, "scope": {"read"}, "audience": {"orders"},
+		"client_id": client["client_id"], "client_secret": client["client_secret"],
+	})
+	require.Equal(t, http.StatusOK, status)
+	require.EqualValues(t, 3600, body["expires_in"])
+	require.Equal(t, "refresh-1", body["refresh_token"])
+	require.Equal(t, "read", s.LastRequest(TokenPath).PostForm.Get("scope"))
+
+	claims := verify(t, s, body["access_token"].(string))
+	require.Equal(t, s.Issuer(), claims["iss"])
+	require.Equal(t, "client", claims["sub"])
+	require.Equal(t, "read", claims["scope"])
+	require.Equal(t, "orders", claims["aud"])
+	require.Equal(t, "acme", claims["tenant"])
+
+	status, _ = postForm(t, s.Endpoint(TokenPath), url.Values{
+		"grant_type": {"client_credentials"}, "client_id": {"client"}, "client_secret": {"wrong"},
+	})
+	require.Equal(t, http.StatusUnauthorized, status)
+
+	refresh := url.Values{"grant_type": {"refresh_token"}, "refresh_token": {"refresh-1"}}
+	for k, v := range client {
+		refresh[k] = v
+	}
+	status, body = postForm(t, s.Endpoint(TokenPath), refresh)
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, "read", verify(t, s, body["access_token"].(string))["scope"], "refreshed token keeps its scope")
+
+	s.RevokeRefreshTokens()
+	status, body = postForm(t, s.Endpoint(TokenPath), refresh)
+	require.Equal(t, http.StatusBadRequest, status)
+	require.Equal(t, "invalid_grant", body["error"])
+	require.Equal(t, 2, s.Issued())
+	require.Equal(t, 4, s.Requests(TokenPath))
+
+	t.Run("keep refresh tokens", func(t *testing.T) {
+		s := NewServer(t, Options{KeepRefreshTokens: true})
+		_, body := postForm(t, s.Endpoint(TokenPath), url.Values{"grant_type": {"client_credentials"}})
+		require.Equal(t, "refresh-1", body["refresh_token"])
+
+		for range 2 {
+			status, body := postForm(t, s.Endpoint(TokenPath), url.Values{"grant_type": {"refresh_token"}, "refresh_token": {"refresh-1"}})
+			require.Equal(t, http.StatusOK, status)
+			require.NotContains(t, body, "refresh_token")
+		}
+	})
+}
+
+func TestServer_Failures(t *testing.T) {
+	s := NewServer(t, Options{OpaqueTokens: true})
+	grant := url.Values{"grant_type": {"client_credentials"}}
+
+	s.Fail(TokenPath, 2, http.StatusInternalServerError)
+	for range 2 {
+		status, body := postForm(t, s.Endpoint(TokenPath), grant)
+		require.Equal(t, http.StatusInternalServerError, status)
+		require.Equal(t, "server_error", body["error"])
+	}
+	status, body := postForm(t, s.Endpoint(TokenPath), grant)
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, "token-1", body["access_token"])
+
+	s.SetLatency(200 * time.Millisecond)
+	client := &http.Client{Timeout: 50 * time.Millisecond}
+	_, err := client.PostForm(s.Endpoint(TokenPath), grant)
+	require.Error(t, err)
+}
+
+func TestServer_Keys(t *testing.T) {
+	s := NewServer(t, Options{})
+	first := s.SigningKeyID()
+	require.Len(t, fetchJWKS(t, s).Keys, 1)
+
+	kid := s.RotateKey()
+	require.NotEqual(t, first, kid)
+	require.Len(t, fetchJWKS(t, s).Keys, 2)
+
+	token := s.Mint(map[string]any{"sub": "42"}, time.Minute)
+	tk, err := jwt.ParseSigned(token, []jose.SignatureAlgorithm{jose.RS256})
+	require.NoError(t, err)
+	require.Equal(t, kid, tk.Headers[0].KeyID)
+	require.Equal(t, "42", verify(t, s, token)["sub"])
+
+	s.RemoveKey(first)
+	require.Len(t, fetchJWKS(t, s).Keys, 1)
+}
+
+func TestServer_DiscoveryAndIntrospection(t *testing.T) {
+	s := NewServer(t, Options{BasePath: "/realms/test", Discovery: true, Introspection: true})
+
+	resp, err := http.Get(s.Endpoint(DiscoveryPath))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	var metadata map[string]string
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&metadata))
+	require.Equal(t, s.URL+"/realms/test", metadata["issuer"])
+	require.Equal(t, s.URL+"/realms/test/token", metadata["token_endpoint"])
+	require.Equal(t, s.URL+"/realms/test/introspect", metadata["introspection_endpoint"])
+
+	introspect := func(token string) map[string]any {
+		status, body := postForm(t, s.Endpoint(IntrospectionPath), url.Values{"token": {token}})
+		require.Equal(t, http.StatusOK, status)
+		return body
+	}
+
+	opaque := s.MintOpaque(map[string]any{"sub": "42"}, time.Minute)
+	require.True(t, strings.HasPrefix(opaque, "opaque-"))
+	body := introspect(opaque)
+	require.Equal(t, true, body["active"])
+	require.Equal(t, "42", body["sub"])
+
+	require.Equal(t, false, introspect(s.MintOpaque(nil, -time.Minute))["active"], "expired")
+	require.Equal(t, false, introspect("unknown")["active"])
+
+	status, _ := postForm(t, s.Endpoint(RevocationPath), url.Values{"token": {opaque}, "token_type_hint": {"access_token"}})
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, false, introspect(opaque)["active"], "revoked")
+	require.Equal(t, []string{"access_token:" + opaque}, s.Revoked())
+}
+
+func TestServer_Device(t *testing.T) {
+	s := NewServer(t, Options{DeviceAuthorization: true})
+
+	authorize := func() (string, string) {
+		status, body := postForm(t, s.Endpoint(DeviceAuthorizationPath), url.Values{"client_id": {"cli"}, "scope": {"openid offline_access"}})
+		require.Equal(t, http.StatusOK, status)
+		require.EqualValues(t, 600, body["expires_in"])
+		require.NotEmpty(t, body["verification_uri"])
+		return body["device_code"].(string), body["user_code"].(string)
+	}
+	poll := func(code string) (int, map[string]any) {
+		return postForm(t, s.Endpoint(TokenPath), url.Values{"grant_type": {deviceCodeGrant}, "device_code": {code}, "client_id": {"cli"}})
+	}
+
+	code, userCode := authorize()
+	_, body := poll(code)
+	require.Equal(t, "authorization_pending", body["error"])
+
+	s.FailWithError(TokenPath, 1, http.StatusBadRequest, "slow_down")
+	_, body = poll(code)
+	require.Equal(t, "slow_down", body["error"])
+
+	require.True(t, s.ApproveDevice(userCode, "alice"))
+	status, body := poll(code)
+	require.Equal(t, http.StatusOK, status)
+	claims := verify(t, s, body["access_token"].(string))
+	require.Equal(t, "alice", claims["sub"])
+	require.Equal(t, "openid offline_access", claims["scope"])
+
+	_, body = poll(code)
+	require.Equal(t, "invalid_grant", body["error"], "device codes are used once")
+
+	code, userCode = authorize()
+	require.True(t, s.DenyDevice(userCode))
+	_, body = poll(code)
+	require.Equal(t, "access_denied", body["error"])
+	require.False(t, s.ApproveDevice("unknown", "alice"))
+}
@@ -0,0 +1,334 @@
+package service
+
+import (
+	"cmp"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+)
+
+const (
+	defaultSignerTokenTTL = 5 * time.Minute
+	// signerJWKSMaxAge caps the Cache-Control max-age of the served JWKS.
+	signerJWKSMaxAge = 5 * time.Minute
+)
+
+// ErrSignerClosed is returned by Signer.Sign and Signer.Rotate after Close.
+var ErrSignerClosed = errors.New("signer is closed")
+
+// SignerConfig configures a Signer created with NewSigner.
+type SignerConfig struct {
+	// Issuer is set as iss on every token.
+	Issuer string
+
+	// Key is the initial signing key. KeyFile is a PEM file read when Key is nil.
+	// Without either a key is generated. KeyID is sent as the kid of Key, the
+	// key's RFC 7638 thumbprint by default; generated keys always use their
+	// thumbprint.
+	Key     crypto.Signer
+	KeyFile string
+	KeyID   string
+	// Algorithm is the signature algorithm, by default RS256, ES256/384/512 or
+	// EdDSA depending on the key type. For generated keys it also selects the key
+	// type: RSA 2048 for RS256 (the default), P-256 for ES256 or Ed25519 for EdDSA.
+	Algorithm jose.SignatureAlgorithm
+
+	// RotationInterval is how often a new key is generated and used for signing.
+	// The next key is published in the JWKS one interval before it is used, so
+	// verifiers learn about it in time. Zero disables rotation.
+	RotationInterval time.Duration
+	// GracePeriod is how long a retired key stays in the JWKS, so tokens it signed
+	// can still be verified. It must cover the lifetime of the tokens; by default
+	// TokenTTL plus DefaultLeeway.
+	GracePeriod time.Duration
+	// TokenTTL is the lifetime of tokens signed without an exp; five minutes by
+	// default.
+	TokenTTL time.Duration
+}
+
+// Signer mints JWTs with a local key and publishes the matching public keys as a
+// JWKS, so that other services can verify the tokens with an Authenticator
+// pointed at JWKSHandler. Keys are kept in memory only: with rotation, each
+// process has its own keys and must serve its own JWKS.
+type Signer struct {
+	issuer      string
+	alg         jose.SignatureAlgorithm
+	ttl         time.Duration
+	gracePeriod time.Duration
+	interval    time.Duration
+
+	mu      sync.RWMutex
+	current *signingKey
+	next    *signingKey
+	retired []*signingKey
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+	closed bool
+}
+
+// signingKey is one key of a Signer.
+type signingKey struct {
+	kid       string
+	key       crypto.Signer
+	signer    jose.Signer
+	retiredAt time.Time
+}
+
+// NewSigner creates a Signer. With a RotationInterval, keys are rotated in the
+// background until ctx is cancelled or Close is called.
+func NewSigner(ctx context.Context, cfg SignerConfig) (*Signer, error) {
+	s := &Signer{
+		issuer:      cfg.Issuer,
+		alg:         cfg.Algorithm,
+		ttl:         cfg.TokenTTL,
+		gracePeriod: cfg.GracePeriod,
+		interval:    cfg.RotationInterval,
+	}
+	if s.ttl <= 0 {
+		s.ttl = defaultSignerTokenTTL
+	}
+	if s.gracePeriod <= 0 {
+		s.gracePeriod = s.ttl + DefaultLeeway
+	}
+
+	key := cfg.Key
+	if key == nil && cfg.KeyFile != "" {
+		var err error
+		if key, err = LoadPrivateKey(cfg.KeyFile); err != nil {
+			return nil, fmt.Errorf("failed to load signing key: %w", err)
+		}
+	}
+
+	var err error
+	if key != nil {
+		if s.alg == "" {
+			s.alg = defaultAlgorithm(key)
+		}
+		s.current, err = s.newSigningKey(key, cfg.KeyID)
+	} else {
+		s.alg = cmp.Or(s.alg, jose.RS256)
+		s.current, err = s.generateKey()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if s.interval <= 0 {
+		return s, nil
+	}
+
+	if s.next, err = s.generateKey(); err != nil {
+		return nil, err
+	}
+
+	ctx, s.cancel = context.WithCancel(ctx)
+	s.wg.Go(func() {
+		ticker := time.NewTicker(s.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				if err := s.Rotate(); err != nil {
+					log.Printf("[ERROR] failed to rotate signing key: %v", err)
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	})
+
+	return s, nil
+}
+
+// Sign returns a JWT carrying claims and, when custom is not nil, the claims
+// custom marshals to. The issuer is set to the configured Issuer, iat to now, exp
+// to TokenTTL from now unless set, and jti to a random UUID unless set.
+func (s *Signer) Sign(claims Claims, custom any) (string, error) {
+	now := time.Now()
+
+	claims.Issuer = s.issuer
+	claims.IssuedAt = jwt.NewNumericDate(now)
+	if claims.Expiry == nil {
+		claims.Expiry = jwt.NewNumericDate(now.Add(s.ttl))
+	}
+	if claims.ID == "" {
+		claims.ID = UUID()
+	}
+
+	s.mu.RLock()
+	closed, key := s.closed, s.current
+	s.mu.RUnlock()
+	if closed {
+		return "", ErrSignerClosed
+	}
+
+	builder := jwt.Signed(key.signer).Claims(claims)
+	if custom != nil {
+		builder = builder.Claims(custom)
+	}
+
+	token, err := builder.Serialize()
+	if err != nil {
+		return "", fmt.Errorf("failed to sign token: %w", err)
+	}
+
+	return token, nil
+}
+
+// Rotate retires the current key and signs with the next one from now on. A new
+// next key is generated and published right away. Retired keys stay in the JWKS
+// for GracePeriod. Rotate runs on the RotationInterval schedule but may also be
+// called directly, e.g. when a key is suspected to be compromised.
+func (s *Signer) Rotate() error {
+	fresh, err := s.generateKey()
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return ErrSignerClosed
+	}
+
+	now := time.Now()
+	s.current.retiredAt = now
+	s.retired = append(slices.DeleteFunc(s.retired, func(k *signingKey) bool {
+		return now.Sub(k.retiredAt) > s.gracePeriod
+	}), s.current)
+
+	if s.next != nil {
+		s.current, s.next = s.next, fresh
+	} else {
+		s.current = fresh
+	}
+
+	return nil
+}
+
+// KeyID returns the kid of the key tokens are currently signed with.
+func (s *Signer) KeyID() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.current.kid
+}
+
+// JWKS returns the public keys to verify tokens with: the current key, the next
+// one and those retired within GracePeriod.
+func (s *Signer) JWKS() jose.JSONWebKeySet {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	keys := []*signingKey{s.current}
+	if s.next != nil {
+		keys = append(keys, s.next)
+	}
+	for _, k := range s.retired {
+		if time.Since(k.retiredAt) <= s.gracePeriod {
+			keys = append(keys, k)
+		}
+	}
+
+	jwks := jose.JSONWebKeySet{}
+	for _, k := range keys {
+		jwks.Keys = append(jwks.Keys, jose.JSONWebKey{Key: k.key.Public(), KeyID: k.kid, Algorithm: string(s.alg), Use: "sig"})
+	}
+
+	return jwks
+}
+
+// JWKSHandler returns an http.Handler serving JWKS, to be mounted at
+// /.well-known/jwks.json. Responses may be cached for half the rotation interval,
+// at most five minutes.
+func (s *Signer) JWKSHandler() http.Handler {
+	maxAge := signerJWKSMaxAge
+	if s.interval > 0 {
+		maxAge = min(maxAge, s.interval/2)
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(maxAge.Seconds())))
+		_ = json.NewEncoder(w).Encode(s.JWKS())
+	})
+}
+
+// Close stops the key rotation. Sign and Rotate fail afterwards.
+func (s *Signer) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	s.mu.Unlock()
+
+	if s.cancel != nil {
+		s.cancel()
+	}
+	s.wg.Wait()
+
+	return nil
+}
+
+// generateKey generates a key of the type matching the Signer's algorithm.
+func (s *Signer) generateKey() (*signingKey, error) {
+	var (
+		key crypto.Signer
+		err error
+	)
+
+	switch s.alg {
+	case jose.RS256, jose.RS384, jose.RS512, jose.PS256, jose.PS384, jose.PS512:
+		key, err = rsa.GenerateKey(rand.Reader, 2048)
+	case jose.ES256:
+		key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case jose.ES384:
+		key, err = ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	case jose.ES512:
+		key, err = ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
+	case jose.EdDSA:
+		_, key, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		return nil, fmt.Errorf("unsupported signing algorithm %q", s.alg)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate signing key: %w", err)
+	}
+
+	return s.newSigningKey(key, "")
+}
+
+// newSigningKey prepares key for signing under kid, its thumbprint when empty.
+func (s *Signer) newSigningKey(key crypto.Signer, kid string) (*signingKey, error) {
+	if kid == "" {
+		thumbprint, err := (&jose.JSONWebKey{Key: key.Public()}).Thumbprint(crypto.SHA256)
+		if err != nil {
+			return nil, fmt.Errorf("failed to compute key thumbprint: %w", err)
+		}
+		kid = base64.RawURLEncoding.EncodeToString(thumbprint)
+	}
+
+	signer, err := newAssertionSigner(key, kid, s.alg)
+	if err != nil {
+		return nil, err
+	}
+
+	return &signingKey{kid: kid, key: key, signer: signer}, nil
+}
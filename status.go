@@ -0,0 +1,103 @@
+package service
+
+import (
+	"math/rand/v2"
+	"sync"
+	"time"
+)
+
+const (
+	defaultRetryMin = time.Second
+	defaultRetryMax = time.Minute
+)
+
+// AuthStatus describes the state of the Authenticator's service token.
+type AuthStatus struct {
+	// LastSuccess is when a token was last obtained or refreshed.
+	LastSuccess time.Time
+	// LastError is the error of the last failed refresh and LastErrorAt when it
+	// happened. They are kept after a later success, so check Failures to tell
+	// whether the Authenticator is currently degraded.
+	LastError   error
+	LastErrorAt time.Time
+	// Failures counts the refreshes that failed since the last success.
+	Failures int
+	// ExpiresAt is when the current token expires, zero if the auth service did
+	// not send expires_in. ExpiresIn is the time left until then, never negative.
+	ExpiresAt time.Time
+	ExpiresIn time.Duration
+}
+
+// Ready reports whether the service token is usable for at least margin more.
+// A token without an expiry is considered usable as long as the last refresh
+// succeeded. Ready is meant for readiness probes, so a replica is taken out of
+// rotation before its token actually expires.
+func (s AuthStatus) Ready(margin time.Duration) bool {
+	if s.LastSuccess.IsZero() {
+		return false
+	}
+	if s.ExpiresAt.IsZero() {
+		return s.Failures == 0
+	}
+	return s.ExpiresIn > margin
+}
+
+// refreshStatus is the part of AuthStatus updated by refreshes.
+type refreshStatus struct {
+	mu          sync.Mutex
+	lastSuccess time.Time
+	lastError   error
+	lastErrorAt time.Time
+	failures    int
+}
+
+// Status returns the current state of the service token.
+func (t *Authenticator) Status() AuthStatus {
+	t.status.mu.Lock()
+	s := AuthStatus{
+		LastSuccess: t.status.lastSuccess,
+		LastError:   t.status.lastError,
+		LastErrorAt: t.status.lastErrorAt,
+		Failures:    t.status.failures,
+	}
+	t.status.mu.Unlock()
+
+	if tk := t.tk.Load(); tk != nil && !tk.expiresAt.IsZero() {
+		s.ExpiresAt = tk.expiresAt
+		s.ExpiresIn = max(time.Until(tk.expiresAt), 0)
+	}
+
+	return s
+}
+
+// recordRefresh updates the status with the outcome of a refresh of the service
+// token and returns the number of consecutive failures.
+func (t *Authenticator) recordRefresh(err error) int {
+	t.status.mu.Lock()
+	defer t.status.mu.Unlock()
+
+	if err != nil {
+		t.status.lastError = err
+		t.status.lastErrorAt = time.Now()
+		t.status.failures++
+		return t.status.failures
+	}
+
+	t.status.lastSuccess = time.Now()
+	t.status.failures = 0
+	return 0
+}
+
+// retryAfter returns how long to wait before retrying after failures consecutive
+// failed refreshes: a random duration up to retryMin doubled per failure and
+// capped at retryMax ("full jitter"), so replicas that failed together do not
+// retry together.
+func (t *Authenticator) retryAfter(failures int) time.Duration {
+	ceiling := t.retryMin
+	for i := 1; i < failures && ceiling < t.retryMax; i++ {
+		ceiling *= 2
+	}
+	ceiling = min(ceiling, t.retryMax)
+
+	return max(rand.N(ceiling), time.Millisecond)
+}
@@ -0,0 +1,383 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// sharedLockTTL bounds how long one replica may hold the refresh lock, and
+	// how long the others wait for its result before running their own grant.
+	sharedLockTTL = 10 * time.Second
+	// sharedPollInterval is how often a waiting replica checks the store.
+	sharedPollInterval = 200 * time.Millisecond
+)
+
+// ErrTokenStoreLocked is returned by TokenStore.Lock when another holder has the lock.
+var ErrTokenStoreLocked = errors.New("token store lock is held")
+
+// TokenStore keeps tokens where several replicas of a service can reach them.
+// An Authenticator configured with one reuses a still valid token saved by
+// another replica instead of running its own grant, and takes a short lock
+// before refreshing, so a deploy does not send every replica to the auth
+// service at once.
+type TokenStore interface {
+	// Load returns the value saved under key, or nil when there is none.
+	Load(ctx context.Context, key string) ([]byte, error)
+	// Save stores value under key for ttl.
+	Save(ctx context.Context, key string, value []byte, ttl time.Duration) error
+	// Lock takes the lock named key for at most ttl and returns the function that
+	// releases it. It returns ErrTokenStoreLocked when the lock is already held.
+	Lock(ctx context.Context, key string, ttl time.Duration) (unlock func(context.Context) error, err error)
+}
+
+// storedToken is the TokenStore representation of a jwtToken.
+type storedToken struct {
+	AccessToken  string    `json:"access_token"`
+	RefreshToken string    `json:"refresh_token,omitempty"`
+	ExpireIn     int       `json:"expires_in"`
+	ExpiresAt    time.Time `json:"expires_at"`
+}
+
+// refreshShared is refresh for an Authenticator with a TokenStore. It adopts a
+// token another replica saved when that token is newer than cur and not yet due
+// for refresh. Otherwise it takes the store's lock, runs the grant and saves the
+// result. While another replica holds the lock it waits for that replica's token,
+// and runs its own grant only if none shows up in time.
+func (t *Authenticator) refreshShared(ctx context.Context, old *jwtToken) error {
+	if err := t.refreshMu.lock(ctx); err != nil {
+		return err
+	}
+	defer t.refreshMu.unlock()
+
+	cur := t.tk.Load()
+	if old != nil && cur != old {
+		return nil
+	}
+
+	if t.adoptShared(ctx, cur) {
+		return nil
+	}
+
+	unlock, err := t.store.Lock(ctx, t.storeKey+":lock", sharedLockTTL)
+	switch {
+	case errors.Is(err, ErrTokenStoreLocked):
+		if t.waitShared(ctx, cur) {
+			return nil
+		}
+	case err != nil:
+		log.Printf("[WARN] failed to lock token store, refreshing without lock: %v", err)
+	default:
+		defer func() {
+			if err := unlock(context.WithoutCancel(ctx)); err != nil {
+				log.Printf("[WARN] failed to unlock token store: %v", err)
+			}
+		}()
+
+		// The previous holder may have saved a token just before releasing the lock.
+		if t.adoptShared(ctx, cur) {
+			return nil
+		}
+	}
+
+	tk, err := t.grant(ctx, cur, t.grantParams)
+	if err != nil {
+		return err
+	}
+	t.tk.Store(tk)
+
+	t.saveShared(ctx, tk)
+
+	return nil
+}
+
+// adoptShared swaps in the stored token when it differs from cur and is not yet
+// due for refresh.
+func (t *Authenticator) adoptShared(ctx context.Context, cur *jwtToken) bool {
+	tk := t.loadShared(ctx)
+	if tk == nil {
+		return false
+	}
+	if cur != nil && cur.AccessToken == tk.AccessToken {
+		return false
+	}
+	if tk.expired() || (!tk.expiresAt.IsZero() && time.Now().After(tk.refreshAt(t.refreshRatio))) {
+		return false
+	}
+
+	t.tk.Store(tk)
+
+	return true
+}
+
+// loadShared returns the stored token, or nil when there is none or it cannot be
+// read.
+func (t *Authenticator) loadShared(ctx context.Context) *jwtToken {
+	data, err := t.store.Load(ctx, t.storeKey)
+	if err != nil {
+		log.Printf("[WARN] failed to load token from store: %v", err)
+		return nil
+	}
+	if data == nil {
+		return nil
+	}
+
+	var st storedToken
+	if err := json.Unmarshal(data, &st); err != nil {
+		log.Printf("[WARN] failed to decode stored token: %v", err)
+		return nil
+	}
+
+	return &jwtToken{AccessToken: st.AccessToken, RefreshToken: st.RefreshToken, ExpireIn: st.ExpireIn, expiresAt: st.ExpiresAt}
+}
+
+// waitShared polls the store for a token saved by the lock holder.
+func (t *Authenticator) waitShared(ctx context.Context, cur *jwtToken) bool {
+	ticker := time.NewTicker(sharedPollInterval)
+	defer ticker.Stop()
+
+	deadline := time.After(sharedLockTTL)
+	for {
+		select {
+		case <-ticker.C:
+			if t.adoptShared(ctx, cur) {
+				return true
+			}
+		case <-deadline:
+			return false
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+// saveShared stores tk until it expires, or for a user's tokens until the refresh
+// token does. Failures only cost other replicas a grant of their own, so they are
+// logged rather than returned.
+func (t *Authenticator) saveShared(ctx context.Context, tk *jwtToken) {
+	if tk.expiresAt.IsZero() {
+		return
+	}
+
+	data, err := json.Marshal(storedToken{AccessToken: tk.AccessToken, RefreshToken: tk.RefreshToken, ExpireIn: tk.ExpireIn, ExpiresAt: tk.expiresAt})
+	if err != nil {
+		log.Printf("[WARN] failed to encode token for store: %v", err)
+		return
+	}
+
+	ttl := time.Until(tk.expiresAt)
+	if t.deviceAuth != nil && tk.RefreshToken != "" {
+		// A user's refresh token saves a login long after the access token expired.
+		ttl = defaultRefreshTokenTTL
+		if tk.RefreshExpireIn > 0 {
+			ttl = time.Duration(tk.RefreshExpireIn) * time.Second
+		}
+	}
+
+	if err := t.store.Save(ctx, t.storeKey, data, ttl); err != nil {
+		log.Printf("[WARN] failed to save token to store: %v", err)
+	}
+}
+
+// RedisTokenStore is a TokenStore on top of the redis Ring returned by NewRedis.
+type RedisTokenStore struct {
+	ring   *redis.Ring
+	prefix string
+}
+
+// NewRedisTokenStore returns a TokenStore keeping its entries under prefix in ring.
+func NewRedisTokenStore(ring *redis.Ring, prefix string) *RedisTokenStore {
+	return &RedisTokenStore{ring: ring, prefix: prefix}
+}
+
+// unlockScript deletes the lock only while it still holds this holder's value,
+// so a holder whose lock expired cannot release the next holder's lock.
+var unlockScript = redis.NewScript(`
+if redis.call("get", KEYS[1]) == ARGV[1] then
+	return redis.call("del", KEYS[1])
+end
+return 0
+`)
+
+// Load implements TokenStore.
+func (s *RedisTokenStore) Load(ctx context.Context, key string) ([]byte, error) {
+	data, err := s.ring.Get(ctx, s.prefix+key).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, nil
+	}
+	return data, err
+}
+
+// Save implements TokenStore.
+func (s *RedisTokenStore) Save(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	return s.ring.Set(ctx, s.prefix+key, value, ttl).Err()
+}
+
+// Lock implements TokenStore.
+func (s *RedisTokenStore) Lock(ctx context.Context, key string, ttl time.Duration) (func(context.Context) error, error) {
+	key = s.prefix + key
+	holder := lockHolder()
+
+	ok, err := s.ring.SetNX(ctx, key, holder, ttl).Result()
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrTokenStoreLocked
+	}
+
+	return func(ctx context.Context) error {
+		return unlockScript.Run(ctx, s.ring, []string{key}, holder).Err()
+	}, nil
+}
+
+// FileTokenStore is a TokenStore keeping entries as files in a directory. It is
+// meant for local development, where several processes share one machine.
+type FileTokenStore struct {
+	dir string
+}
+
+// NewFileTokenStore returns a TokenStore writing to dir, which is created if needed.
+func NewFileTokenStore(dir string) (*FileTokenStore, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("create token store dir: %w", err)
+	}
+	return &FileTokenStore{dir: dir}, nil
+}
+
+// fileEntry is the on-disk format of a FileTokenStore entry.
+type fileEntry struct {
+	Value     []byte    `json:"value"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// Load implements TokenStore.
+func (s *FileTokenStore) Load(_ context.Context, key string) ([]byte, error) {
+	data, err := os.ReadFile(s.path(key))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var entry fileEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return nil, err
+	}
+	if time.Now().After(entry.ExpiresAt) {
+		return nil, nil
+	}
+
+	return entry.Value, nil
+}
+
+// Save implements TokenStore. The file is replaced atomically and is readable
+// by its owner only.
+func (s *FileTokenStore) Save(_ context.Context, key string, value []byte, ttl time.Duration) error {
+	data, err := json.Marshal(fileEntry{Value: value, ExpiresAt: time.Now().Add(ttl)})
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(s.dir, ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = os.Remove(tmp.Name())
+	}()
+
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), s.path(key))
+}
+
+// Lock implements TokenStore with an exclusively created lock file holding its
+// expiry. A lock file left behind by a crashed process is taken over once it
+// has expired.
+func (s *FileTokenStore) Lock(_ context.Context, key string, ttl time.Duration) (func(context.Context) error, error) {
+	path := s.path(key)
+	holder := lockHolder()
+
+	for range 2 {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+		if errors.Is(err, fs.ErrExist) {
+			if !lockFileExpired(path) {
+				return nil, ErrTokenStoreLocked
+			}
+			_ = os.Remove(path)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		_, err = f.WriteString(holder + " " + strconv.FormatInt(time.Now().Add(ttl).UnixNano(), 10))
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			_ = os.Remove(path)
+			return nil, err
+		}
+
+		return func(context.Context) error {
+			data, err := os.ReadFile(path)
+			if err != nil || string(data[:min(len(data), len(holder))]) != holder {
+				return nil
+			}
+			return os.Remove(path)
+		}, nil
+	}
+
+	return nil, ErrTokenStoreLocked
+}
+
+func (s *FileTokenStore) path(key string) string {
+	return filepath.Join(s.dir, tokenHash(key))
+}
+
+// lockFileExpired reports whether the lock file at path is past its expiry.
+func lockFileExpired(path string) bool {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return false
+	}
+
+	var holder string
+	var deadline int64
+	if _, err := fmt.Sscan(string(data), &holder, &deadline); err != nil {
+		// A lock file being written right now has no deadline yet; one that stays
+		// incomplete was left by a process that died while writing it.
+		info, err := os.Stat(path)
+		return err == nil && time.Since(info.ModTime()) > time.Minute
+	}
+
+	return time.Now().UnixNano() > deadline
+}
+
+// lockHolder returns a random value identifying one lock acquisition.
+func lockHolder() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,142 @@
+package service
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// Transport is an http.RoundTripper that sends the Authenticator's access token
+// as a Bearer Authorization header, or with DPoP enabled as a DPoP token with a
+// proof. When the server answers 401 it refreshes the token once and retries the
+// request. Concurrent 401s observed for the same token share a single refresh. A
+// 401 asking for a DPoP nonce is first retried with the nonce and the same token.
+//
+// Requests with a body are only retried when GetBody is set, which
+// http.NewRequest does for the common in-memory body types; otherwise the 401 is
+// returned as is.
+type Transport struct {
+	Auth *Authenticator
+	// Base performs the requests; http.DefaultTransport when nil.
+	Base http.RoundTripper
+}
+
+// Client returns an *http.Client that authorizes every request through Transport.
+func (t *Authenticator) Client() *http.Client {
+	return &http.Client{Transport: &Transport{Auth: t}}
+}
+
+// RoundTrip implements http.RoundTripper.
+func (tr *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	tk := tr.Auth.current(req.Context())
+
+	first, err := tr.Auth.authorize(req, tk)
+	if err != nil {
+		// The RoundTripper contract requires the body to be closed, even on errors.
+		if req.Body != nil {
+			_ = req.Body.Close()
+		}
+		return nil, err
+	}
+
+	resp, err := tr.send(first)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		return resp, nil
+	}
+
+	if tr.Auth.dpop != nil && dpopNonceRequired(resp) {
+		retry, err := tr.rewind(req, tk)
+		if err != nil {
+			return resp, nil
+		}
+		discard(resp)
+
+		if resp, err = tr.send(retry); err != nil || resp.StatusCode != http.StatusUnauthorized {
+			return resp, err
+		}
+	}
+
+	if err := tr.Auth.refresh(req.Context(), tk); err != nil {
+		log.Printf("[ERROR] failed to refresh token after 401: %v", err)
+		return resp, nil
+	}
+
+	retry, err := tr.rewind(req, tr.Auth.tk.Load())
+	if err != nil {
+		return resp, nil
+	}
+
+	// The first response is discarded; drain it so the connection can be reused.
+	discard(resp)
+
+	return tr.send(retry)
+}
+
+// send performs r, keeping track of the DPoP nonces the server sends.
+func (tr *Transport) send(r *http.Request) (*http.Response, error) {
+	resp, err := tr.base().RoundTrip(r)
+	if err == nil && tr.Auth.dpop != nil {
+		tr.Auth.dpop.track(r.URL.String(), resp)
+	}
+	return resp, err
+}
+
+// rewind returns a copy of req carrying tk with a fresh body, for a retry.
+func (tr *Transport) rewind(req *http.Request, tk *jwtToken) (*http.Request, error) {
+	retry, err := tr.Auth.authorize(req, tk)
+	if err != nil {
+		return nil, err
+	}
+
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		retry.Body = body
+	}
+
+	return retry, nil
+}
+
+func (tr *Transport) base() http.RoundTripper {
+	if tr.Base != nil {
+		return tr.Base
+	}
+	return http.DefaultTransport
+}
+
+// authorize returns a copy of req carrying tk, leaving req untouched as the
+// RoundTripper contract requires. DPoP tokens are sent with a proof for req.
+func (t *Authenticator) authorize(req *http.Request, tk *jwtToken) (*http.Request, error) {
+	r := req.Clone(req.Context())
+	if tk == nil {
+		return r, nil
+	}
+
+	if t.dpop == nil || !strings.EqualFold(tk.TokenType, dpopScheme) {
+		r.Header.Set("Authorization", "Bearer "+tk.AccessToken)
+		return r, nil
+	}
+
+	proof, err := t.dpop.proof(r.Method, r.URL.String(), tk.AccessToken)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create DPoP proof: %w", err)
+	}
+	r.Header.Set("Authorization", dpopScheme+" "+tk.AccessToken)
+	r.Header.Set("DPoP", proof)
+
+	return r, nil
+}
+
+// discard drains and closes resp's body so the connection can be reused.
+func discard(resp *http.Response) {
+	_, _ = io.Copy(io.Discard, resp.Body)
+	_ = resp.Body.Close()
+}
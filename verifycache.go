@@ -0,0 +1,72 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/go-jose/go-jose/v4/jwt"
+)
+
+// verifiedToken is a verify result kept by the verified-token cache.
+type verifiedToken struct {
+	payload []byte
+	// version is the keySet version the signature was checked against.
+	version uint64
+}
+
+// CacheStats reports the use of the verified-token cache.
+type CacheStats struct {
+	Hits   uint64
+	Misses uint64
+	// Size is the number of cached tokens, including expired ones not yet dropped.
+	Size int
+}
+
+// VerifyCacheStats returns the hit and miss counts and the size of the cache
+// enabled with VerifyCacheSize. All are zero when the cache is disabled.
+func (t *Authenticator) VerifyCacheStats() CacheStats {
+	if t.verified == nil {
+		return CacheStats{}
+	}
+
+	return CacheStats{
+		Hits:   t.verifyHits.Load(),
+		Misses: t.verifyMisses.Load(),
+		Size:   t.verified.len(),
+	}
+}
+
+// verify checks token's signature like verifySignature. When the cache is
+// enabled, tokens carrying exp are remembered by hash until then, so repeated
+// tokens skip the signature check. Entries are only used with the key set they
+// were checked against, and the cache is cleared when that set changes.
+func (t *Authenticator) verify(ctx context.Context, token string) ([]byte, error) {
+	if t.verified == nil {
+		return t.verifySignature(ctx, token)
+	}
+
+	key := tokenHash(token)
+	version := t.jwks.version.Load()
+
+	if v, ok := t.verified.get(key, time.Now()); ok && v.version == version {
+		t.verifyHits.Add(1)
+		return bytes.Clone(v.payload), nil
+	}
+	t.verifyMisses.Add(1)
+
+	payload, err := t.verifySignature(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+
+	var claims struct {
+		Expiry *jwt.NumericDate `json:"exp"`
+	}
+	if json.Unmarshal(payload, &claims) == nil && claims.Expiry != nil {
+		t.verified.set(key, &verifiedToken{payload: bytes.Clone(payload), version: version}, claims.Expiry.Time())
+	}
+
+	return payload, nil
+}